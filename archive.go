@@ -0,0 +1,110 @@
+package marmot
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "bytes"
+  "compress/gzip"
+  "fmt"
+  "io"
+  "io/fs"
+  "io/ioutil"
+  "path"
+  "strings"
+  "time"
+)
+
+// Creates a new FileCollection which reads templates directly from the zip, tar or gzipped tar archive at the
+// given path, without extracting it. The format is detected from the archive's contents rather than its
+// extension. The archive is read again every time the collection is resolved, so reloading a Cache picks up a
+// new version of the archive.
+//
+// Only the files under root, a slash-separated path within the archive, are used; use "." for the whole archive.
+// Templates are named by their path relative to root, in the same way as for Directory, and the paths reported in
+// errors are of the form archive.zip:path/to/template.gohtml.
+func Archive(archivePath, root string) Dir {
+  return directory{roots: []fsRoot{{
+    root:   path.Clean(root),
+    prefix: archivePath + ":",
+    open: func() (fs.FS, error) {
+      data, err := ioutil.ReadFile(archivePath)
+      if err != nil {
+        return nil, err
+      }
+      return openArchive(bytes.NewReader(data), int64(len(data)))
+    },
+  }}}
+}
+
+// Creates a new FileCollection which reads templates from a zip, tar or gzipped tar archive, in the same way as
+// Archive. The archive is read from r, which must contain size bytes, every time the collection is resolved.
+func ArchiveReader(r io.ReaderAt, size int64, root string) Dir {
+  return directory{roots: []fsRoot{{
+    root: path.Clean(root),
+    open: func() (fs.FS, error) {
+      return openArchive(r, size)
+    },
+  }}}
+}
+
+var (
+  zipMagic  = []byte("PK\x03\x04")
+  gzipMagic = []byte("\x1f\x8b")
+)
+
+// Opens the archive in r as an fs.FS, detecting whether it is a zip, a tar or a gzipped tar archive.
+func openArchive(r io.ReaderAt, size int64) (fs.FS, error) {
+  magic := make([]byte, len(zipMagic))
+  n, err := r.ReadAt(magic, 0)
+  if err != nil && err != io.EOF {
+    return nil, err
+  }
+  magic = magic[:n]
+
+  if bytes.HasPrefix(magic, zipMagic) {
+    return zip.NewReader(r, size)
+  }
+
+  var tarData io.Reader = io.NewSectionReader(r, 0, size)
+  if bytes.HasPrefix(magic, gzipMagic) {
+    gzipReader, err := gzip.NewReader(tarData)
+    if err != nil {
+      return nil, err
+    }
+    defer gzipReader.Close()
+    tarData = gzipReader
+  }
+  return readTar(tarData)
+}
+
+// Reads the regular files in a tar archive into a memFS.
+func readTar(r io.Reader) (fs.FS, error) {
+  files := make(map[string][]byte)
+  var modTime time.Time
+  tarReader := tar.NewReader(r)
+  for {
+    header, err := tarReader.Next()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      return nil, err
+    }
+    // The tar reader reports regular files from legacy archives as TypeReg too.
+    if header.Typeflag != tar.TypeReg {
+      continue
+    }
+    name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+    if !fs.ValidPath(name) {
+      return nil, fmt.Errorf("invalid path %s in tar archive", header.Name)
+    }
+    data, err := ioutil.ReadAll(tarReader)
+    if err != nil {
+      return nil, err
+    }
+    files[name] = data
+    if header.ModTime.After(modTime) {
+      modTime = header.ModTime
+    }
+  }
+  return newMemFS(files, modTime), nil
+}
@@ -0,0 +1,130 @@
+package marmot
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "bytes"
+  "compress/gzip"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+var archiveTemplates = []struct {
+  path, content string
+}{
+  {"theme/base.tmpl", `Hello {{template "name" .}}`},
+  {"theme/pages/Page.tmpl", `{{extend "base"}}{{define "name"}}{{.Name}}{{end}}`},
+  {"theme/pages/Broken.tmpl", `{{extend "missing"}}`},
+  {"README.md", `not a template`},
+}
+
+func zipArchive(t *testing.T) []byte {
+  buf := new(bytes.Buffer)
+  w := zip.NewWriter(buf)
+  for _, file := range archiveTemplates {
+    fw, err := w.Create(file.path)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if _, err := fw.Write([]byte(file.content)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := w.Close(); err != nil {
+    t.Fatal(err)
+  }
+  return buf.Bytes()
+}
+
+func tarArchive(t *testing.T, compress bool) []byte {
+  buf := new(bytes.Buffer)
+  var gw *gzip.Writer
+  var w *tar.Writer
+  if compress {
+    gw = gzip.NewWriter(buf)
+    w = tar.NewWriter(gw)
+  } else {
+    w = tar.NewWriter(buf)
+  }
+  for _, file := range archiveTemplates {
+    header := &tar.Header{Name: file.path, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}
+    if err := w.WriteHeader(header); err != nil {
+      t.Fatal(err)
+    }
+    if _, err := w.Write([]byte(file.content)); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := w.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if gw != nil {
+    if err := gw.Close(); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return buf.Bytes()
+}
+
+func TestArchive(t *testing.T) {
+  archives := map[string][]byte{
+    "theme.zip":    zipArchive(t),
+    "theme.tar":    tarArchive(t, false),
+    "theme.tar.gz": tarArchive(t, true),
+  }
+
+  dir, err := ioutil.TempDir("", "marmot")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  for name, data := range archives {
+    archivePath := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(archivePath, data, 0644); err != nil {
+      t.Fatal(err)
+    }
+
+    for _, fc := range []Dir{
+      Archive(archivePath, "theme").MatchExtensions("tmpl"),
+      ArchiveReader(bytes.NewReader(data), int64(len(data)), "theme").MatchExtensions("tmpl"),
+    } {
+      files, err := fc.Resolve()
+      if err != nil {
+        t.Fatalf("%s: %v", name, err)
+      }
+      if strings.Join(files.Names, " ") != "base pages/Broken pages/Page" {
+        t.Errorf("%s: unexpected templates %v", name, files.Names)
+      }
+
+      var missing *MissingDependencyError
+      err = TextCache().Load(fc)
+      if !errors.As(err, &missing) {
+        t.Errorf("%s: expected MissingDependencyError, got %v", name, err)
+      }
+
+      cache := TextCache(ExportRule(func(name string) TemplateType {
+        return TemplateType(name == "pages/Page")
+      }))
+      if err := cache.Load(fc); err != nil {
+        t.Fatalf("%s: %v", name, err)
+      }
+      str, err := cache.Builder("pages/page").With("Name", "archive").ExecStr()
+      if err != nil {
+        t.Fatalf("%s: %v", name, err)
+      }
+      if str != "Hello archive" {
+        t.Errorf("%s: incorrect output %q", name, str)
+      }
+    }
+
+    files, _ := Archive(archivePath, "theme").Resolve()
+    if expect := archivePath + ":theme/pages/Page.tmpl"; files.Paths["pages/Page"] != expect {
+      t.Errorf("%s: expected path %s, got %s", name, expect, files.Paths["pages/Page"])
+    }
+  }
+}
@@ -0,0 +1,136 @@
+package marmot
+
+import (
+  "sort"
+  "sync"
+  "text/template/parse"
+)
+
+// A Block describes which template supplies a block, that is a template created with {{define}} or {{block}},
+// when an exported template is executed.
+//
+// The templates in an exported template's stack are parsed in order, and each non-empty definition of a block
+// replaces any earlier definition. An empty definition never replaces an existing one.
+type Block struct {
+  // The name of the block.
+  Name string
+  // The name of the template whose definition of the block is used.
+  Template string
+  // The names of the templates whose definitions of the block were replaced, in the order they were parsed.
+  Shadowed []string
+}
+
+type blockDef struct {
+  name  string
+  empty bool
+}
+
+// The blocks defined by a single template, which are only found when they are needed.
+type blockDefs struct {
+  once sync.Once
+  defs []blockDef
+  err  error
+}
+
+// Returns the blocks defined by the named template, in alphabetical order, excluding the template's own body.
+func (set *templateSet) blockDefs(name string) ([]blockDef, error) {
+  data := set.data[name]
+  data.blocks.once.Do(func() {
+    tree := parse.New(name)
+    tree.Mode = parse.SkipFuncCheck
+    trees := make(map[string]*parse.Tree)
+    left, right := set.config.leftDelim(), set.config.rightDelim()
+    if _, err := tree.Parse(string(data.content), left, right, trees); err != nil {
+      data.blocks.err = set.errParse(name, err)
+      return
+    }
+    for blockName, blockTree := range trees {
+      if blockName != name {
+        def := blockDef{name: blockName, empty: parse.IsEmptyTree(blockTree.Root)}
+        data.blocks.defs = append(data.blocks.defs, def)
+      }
+    }
+    sort.Slice(data.blocks.defs, func(i, j int) bool {
+      return data.blocks.defs[i].name < data.blocks.defs[j].name
+    })
+  })
+  return data.blocks.defs, data.blocks.err
+}
+
+// Works out which template supplies each block used by the named exported template.
+func (set *templateSet) resolveBlocks(name string) ([]Block, error) {
+  blocks := make(map[string]*Block)
+  var names []string
+  for _, tplName := range set.stacks[name] {
+    defs, err := set.blockDefs(tplName)
+    if err != nil {
+      return nil, err.(*ParseError).withTemplate(name)
+    }
+    for _, def := range defs {
+      block, ok := blocks[def.name]
+      if !ok {
+        blocks[def.name] = &Block{Name: def.name, Template: tplName}
+        names = append(names, def.name)
+      } else if !def.empty {
+        block.Shadowed = append(block.Shadowed, block.Template)
+        block.Template = tplName
+      }
+    }
+  }
+  sort.Strings(names)
+  resolved := make([]Block, len(names))
+  for i, blockName := range names {
+    resolved[i] = *blocks[blockName]
+  }
+  return resolved, nil
+}
+
+// Returns an error if any block used by the named exported template is defined by one included template and then
+// shadowed by another, unless the second template extends the first. Shadowing a block defined by the exported
+// template or one of its ancestors is always allowed.
+func (set *templateSet) checkShadowing(name string) error {
+  blocks, err := set.resolveBlocks(name)
+  if err != nil {
+    return err
+  }
+  chain := set.ancestors(name)
+  chain[name] = true
+  for _, block := range blocks {
+    definedBy := append(block.Shadowed, block.Template)
+    for i := 1; i < len(definedBy); i++ {
+      shadowed, shadowing := definedBy[i-1], definedBy[i]
+      if chain[shadowed] || chain[shadowing] || set.ancestors(shadowing)[shadowed] {
+        continue
+      }
+      return &ShadowedBlockError{
+        Template:     name,
+        Block:        block.Name,
+        Name:         shadowing,
+        Path:         set.files.Paths[shadowing],
+        ShadowedName: shadowed,
+        ShadowedPath: set.files.Paths[shadowed],
+      }
+    }
+  }
+  return nil
+}
+
+// Returns the templates which the named template extends, directly or indirectly, ignoring includes.
+func (set *templateSet) ancestors(name string) map[string]bool {
+  ancestors := make(map[string]bool)
+  queue := []string{name}
+  for len(queue) > 0 {
+    data, ok := set.data[queue[0]]
+    queue = queue[1:]
+    if !ok {
+      continue
+    }
+    for _, parent := range data.extends {
+      if !ancestors[parent] {
+        ancestors[parent] = true
+        queue = append(queue, parent)
+      }
+    }
+  }
+  return ancestors
+}
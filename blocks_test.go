@@ -0,0 +1,76 @@
+package marmot
+
+import (
+  "errors"
+  "reflect"
+  "testing"
+)
+
+func TestBlocks(t *testing.T) {
+  files := map[string][]byte{
+    "base.tmpl":    []byte(`{{block "title" .}}Default{{end}} {{block "content" .}}{{end}} {{template "menu"}}`),
+    "nav.tmpl":     []byte(`{{define "menu"}}Nav{{end}}`),
+    "sidebar.tmpl": []byte(`{{define "menu"}}Sidebar{{end}}`),
+    "Page.tmpl": []byte(
+      `{{extend "base"}}{{include "nav sidebar"}}{{define "content"}}Hi{{end}}{{define "title"}}{{end}}`,
+    ),
+  }
+
+  cache := TextCache()
+  if err := cache.Load(PreloadedFiles(files)); err != nil {
+    t.Fatal(err)
+  }
+
+  blocks, err := cache.Blocks("page")
+  if err != nil {
+    t.Fatal(err)
+  }
+  expect := []Block{
+    {Name: "content", Template: "Page", Shadowed: []string{"base"}},
+    {Name: "menu", Template: "sidebar", Shadowed: []string{"nav"}},
+    {Name: "title", Template: "base"},
+  }
+  if !reflect.DeepEqual(blocks, expect) {
+    t.Errorf("expected blocks %v, got %v", expect, blocks)
+  }
+
+  var shadowed *ShadowedBlockError
+  err = TextCache(StrictBlocks(true)).Load(PreloadedFiles(files))
+  if !errors.As(err, &shadowed) || shadowed.Block != "menu" || shadowed.Name != "sidebar" ||
+    shadowed.ShadowedName != "nav" {
+    t.Errorf("expected ShadowedBlockError, got %v", err)
+  }
+
+  files["sidebar.tmpl"] = []byte(`{{extend "nav"}}{{define "menu"}}Sidebar{{end}}`)
+  if err := TextCache(StrictBlocks(true)).Load(PreloadedFiles(files)); err != nil {
+    t.Errorf("expected shadowing a parent's block to be allowed, got %v", err)
+  }
+
+  delimited := map[string][]byte{
+    "base.tmpl":    []byte(`[[block "title" .]]Default[[end]] [[template "menu"]]`),
+    "nav.tmpl":     []byte(`[[define "menu"]]Nav[[end]]`),
+    "sidebar.tmpl": []byte(`[[define "menu"]]Sidebar[[end]]`),
+    "Page.tmpl":    []byte(`[[extend "base"]][[include "nav"]][[define "title"]]{{Page}}[[end]]`),
+  }
+  cache = TextCache(Delims("[[", "]]"))
+  if err := cache.Load(PreloadedFiles(delimited)); err != nil {
+    t.Fatal(err)
+  }
+  blocks, err = cache.Blocks("page")
+  expect = []Block{
+    {Name: "menu", Template: "nav"},
+    {Name: "title", Template: "Page", Shadowed: []string{"base"}},
+  }
+  if err != nil || !reflect.DeepEqual(blocks, expect) {
+    t.Errorf("expected blocks %v with custom delimiters, got %v %v", expect, blocks, err)
+  }
+  if str, err := cache.Builder("page").ExecStr(); err != nil || str != "{{Page}} Nav" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+
+  delimited["Page.tmpl"] = []byte(`[[extend "base"]][[include "nav sidebar"]][[define "title"]]Page[[end]]`)
+  err = TextCache(Delims("[[", "]]"), StrictBlocks(true)).Load(PreloadedFiles(delimited))
+  if !errors.As(err, &shadowed) || shadowed.Block != "menu" || shadowed.Name != "sidebar" {
+    t.Errorf("expected ShadowedBlockError with custom delimiters, got %v", err)
+  }
+}
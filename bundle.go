@@ -0,0 +1,305 @@
+package marmot
+
+import (
+  "archive/tar"
+  "bytes"
+  "compress/gzip"
+  "crypto/ed25519"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "io/ioutil"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+const (
+  // The path within a bundle of its manifest, which lists the SHA-256 hash of every template in the bundle.
+  BundleManifestName = ".marmot-manifest.json"
+
+  // The path within a bundle of the Ed25519 signature of its manifest.
+  BundleSignatureName = ".marmot-manifest.sig"
+)
+
+// The manifest of a bundle, which maps the path of each template to the hex-encoded SHA-256 hash of its content.
+type bundleManifest struct {
+  Files map[string]string `json:"files"`
+}
+
+// Writes every template in the FileCollection to w as a signed bundle: a gzipped tar archive containing the
+// templates, a manifest of their SHA-256 hashes and an Ed25519 signature of the manifest made with the given key.
+// The bundle can be loaded with Bundle or BundleReader.
+//
+// Each template is stored at its name followed by the extension of its file, so that the templates are named the
+// same when the bundle is loaded.
+func WriteBundle(w io.Writer, fc FileCollection, key ed25519.PrivateKey) error {
+  files, err := fc.Resolve()
+  if err != nil {
+    return err
+  }
+
+  manifest := bundleManifest{Files: make(map[string]string, len(files.Names))}
+  contents := make(map[string][]byte, len(files.Names))
+  for _, name := range files.Names {
+    content, err := files.Read(name)
+    if err != nil {
+      return err
+    }
+    bundlePath := name + filepath.Ext(files.Paths[name])
+    hash := sha256.Sum256(content)
+    manifest.Files[bundlePath] = hex.EncodeToString(hash[:])
+    contents[bundlePath] = content
+  }
+  manifestData, err := json.MarshalIndent(manifest, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  gzipWriter := gzip.NewWriter(w)
+  tarWriter := tar.NewWriter(gzipWriter)
+  write := func(name string, data []byte) error {
+    header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+    if err := tarWriter.WriteHeader(header); err != nil {
+      return err
+    }
+    _, err := tarWriter.Write(data)
+    return err
+  }
+
+  if err := write(BundleManifestName, manifestData); err != nil {
+    return err
+  }
+  if err := write(BundleSignatureName, ed25519.Sign(key, manifestData)); err != nil {
+    return err
+  }
+  sorted := make([]string, 0, len(contents))
+  for bundlePath := range contents {
+    sorted = append(sorted, bundlePath)
+  }
+  sort.Strings(sorted)
+  for _, bundlePath := range sorted {
+    if err := write(bundlePath, contents[bundlePath]); err != nil {
+      return err
+    }
+  }
+
+  if err := tarWriter.Close(); err != nil {
+    return err
+  }
+  return gzipWriter.Close()
+}
+
+// Returned when a signed bundle fails verification.
+type BundleError struct {
+  // The path of the bundle, or an empty string if it was read with BundleReader.
+  Bundle string
+  // The name and path within the bundle of the template which failed verification, or empty strings if the
+  // bundle's signature or manifest failed verification.
+  Name string
+  Path string
+  // Why verification failed.
+  Reason string
+}
+
+func (e *BundleError) Error() string {
+  bundle := e.Bundle
+  if bundle == "" {
+    bundle = "bundle"
+  }
+  if e.Path == "" {
+    return fmt.Sprintf("%s: %s", bundle, e.Reason)
+  }
+  return fmt.Sprintf("%s: template %s (%s) %s", bundle, e.Name, e.Path, e.Reason)
+}
+
+func (e *BundleError) Is(target error) bool {
+  return target == ErrBundle
+}
+
+// Creates a new FileCollection which reads templates from the signed bundle at the given path, which must have been
+// written by WriteBundle. The bundle is read again and verified every time the collection is resolved. Resolving
+// fails with a BundleError if the manifest's signature cannot be verified with the public key, or if any template
+// in the bundle is not in the manifest or does not match its hash.
+//
+// Templates are named by their paths within the bundle, in the same way as for Archive, and the paths reported in
+// errors are of the form bundle.tar.gz:path/to/template.gohtml.
+func Bundle(bundlePath string, key ed25519.PublicKey) FileCollection {
+  return signedBundle{
+    name:   bundlePath,
+    prefix: bundlePath + ":",
+    key:    key,
+    open: func() (fs.FS, error) {
+      data, err := ioutil.ReadFile(bundlePath)
+      if err != nil {
+        return nil, err
+      }
+      return openArchive(bytes.NewReader(data), int64(len(data)))
+    },
+  }
+}
+
+// Creates a new FileCollection which reads templates from a signed bundle, in the same way as Bundle. The bundle
+// is read from r, which must contain size bytes, every time the collection is resolved.
+func BundleReader(r io.ReaderAt, size int64, key ed25519.PublicKey) FileCollection {
+  return signedBundle{
+    key: key,
+    open: func() (fs.FS, error) {
+      return openArchive(r, size)
+    },
+  }
+}
+
+type signedBundle struct {
+  name   string
+  prefix string
+  key    ed25519.PublicKey
+  open   func() (fs.FS, error)
+}
+
+// Reads the template at a path returned by Resolve directly from the bundle. The manifest's signature and the
+// template's hash are verified, but the rest of the bundle is not.
+func (b signedBundle) Read(filePath string) ([]byte, error) {
+  bundlePath := strings.TrimPrefix(filePath, b.prefix)
+  if !strings.HasPrefix(filePath, b.prefix) || !fs.ValidPath(bundlePath) {
+    return nil, &os.PathError{Op: "read", Path: filePath, Err: os.ErrNotExist}
+  }
+  fsys, err := b.open()
+  if err != nil {
+    return nil, err
+  }
+  manifest, err := b.manifest(fsys)
+  if err != nil {
+    return nil, err
+  }
+  if _, ok := manifest.Files[bundlePath]; !ok {
+    return nil, b.errTemplate(DefaultNameRule, bundlePath, "is not in the manifest")
+  }
+  return b.verifyTemplate(fsys, manifest, bundlePath, DefaultNameRule)
+}
+
+func (b signedBundle) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(b, defaultResolution)
+}
+
+func (b signedBundle) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  fsys, err := b.open()
+  if err != nil {
+    return ResolvedFileCollection{}, nil, err
+  }
+  files, err := b.verify(fsys, res.rule)
+  if err != nil {
+    return ResolvedFileCollection{}, nil, err
+  }
+
+  sorted := make([]string, 0, len(files))
+  for bundlePath := range files {
+    sorted = append(sorted, bundlePath)
+  }
+  sort.Strings(sorted)
+  snapshot := verifiedBundle{signedBundle: b, files: make(map[string][]byte, len(files))}
+  r := newResolver()
+  for _, bundlePath := range sorted {
+    snapshot.files[b.prefix+bundlePath] = files[bundlePath]
+    r.add(res.rule.name(bundlePath), b.prefix+bundlePath, b.prefix+bundlePath)
+  }
+  return r.resolved(snapshot), r.duplicates, nil
+}
+
+// Verifies the signature of the bundle's manifest and the hash of every template in the bundle, returning the
+// content of every template indexed by its path within the bundle.
+func (b signedBundle) verify(fsys fs.FS, rule NameRule) (map[string][]byte, error) {
+  manifest, err := b.manifest(fsys)
+  if err != nil {
+    return nil, err
+  }
+
+  files := make(map[string][]byte, len(manifest.Files))
+  err = fs.WalkDir(fsys, ".", func(filePath string, entry fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    if entry.IsDir() || filePath == BundleManifestName || filePath == BundleSignatureName {
+      return nil
+    }
+    if _, ok := manifest.Files[filePath]; !ok {
+      return b.errTemplate(rule, filePath, "is not in the manifest")
+    }
+    content, err := b.verifyTemplate(fsys, manifest, filePath, rule)
+    if err != nil {
+      return err
+    }
+    files[filePath] = content
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  for filePath := range manifest.Files {
+    if _, ok := files[path.Clean(filePath)]; !ok {
+      return nil, b.errTemplate(rule, filePath, "is missing from the bundle")
+    }
+  }
+  return files, nil
+}
+
+// Reads the bundle's manifest, verifying its signature.
+func (b signedBundle) manifest(fsys fs.FS) (bundleManifest, error) {
+  var manifest bundleManifest
+  manifestData, err := fs.ReadFile(fsys, BundleManifestName)
+  if err != nil {
+    return manifest, &BundleError{Bundle: b.name, Reason: "has no manifest"}
+  }
+  signature, err := fs.ReadFile(fsys, BundleSignatureName)
+  if err != nil {
+    return manifest, &BundleError{Bundle: b.name, Reason: "has no signature"}
+  }
+  if len(b.key) != ed25519.PublicKeySize || !ed25519.Verify(b.key, manifestData, signature) {
+    return manifest, &BundleError{Bundle: b.name, Reason: "signature is not valid"}
+  }
+  if err := json.Unmarshal(manifestData, &manifest); err != nil {
+    return manifest, &BundleError{Bundle: b.name, Reason: fmt.Sprintf("manifest is not valid: %v", err)}
+  }
+  return manifest, nil
+}
+
+// Reads the template at the path within the bundle, verifying that it matches its hash in the manifest.
+func (b signedBundle) verifyTemplate(
+  fsys fs.FS, manifest bundleManifest, filePath string, rule NameRule,
+) ([]byte, error) {
+  content, err := fs.ReadFile(fsys, filePath)
+  if errors.Is(err, fs.ErrNotExist) {
+    return nil, b.errTemplate(rule, filePath, "is missing from the bundle")
+  } else if err != nil {
+    return nil, err
+  }
+  if hash := sha256.Sum256(content); hex.EncodeToString(hash[:]) != manifest.Files[filePath] {
+    return nil, b.errTemplate(rule, filePath, "does not match the hash in the manifest")
+  }
+  return content, nil
+}
+
+func (b signedBundle) errTemplate(rule NameRule, filePath, reason string) error {
+  return &BundleError{Bundle: b.name, Name: rule.name(filePath), Path: filePath, Reason: reason}
+}
+
+// The FileCollection of a resolved bundle, which keeps reading the templates verified when it was resolved.
+// Resolving it again reads and verifies the bundle again.
+type verifiedBundle struct {
+  signedBundle
+  files map[string][]byte
+}
+
+func (b verifiedBundle) Read(path string) ([]byte, error) {
+  content, ok := b.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+  }
+  return content, nil
+}
@@ -0,0 +1,135 @@
+package marmot
+
+import (
+  "archive/tar"
+  "bytes"
+  "compress/gzip"
+  "crypto/ed25519"
+  "errors"
+  "io"
+  "io/ioutil"
+  "strings"
+  "testing"
+)
+
+func TestBundle(t *testing.T) {
+  public, private, err := ed25519.GenerateKey(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  buf := new(bytes.Buffer)
+  err = WriteBundle(buf, PreloadedFiles(map[string][]byte{
+    "base.tmpl":        []byte(`<{{template "content"}}>`),
+    "pages/Home.tmpl":  []byte(`{{extend "base"}}{{define "content"}}home{{end}}`),
+    "pages/About.tmpl": []byte(`{{extend "base"}}{{define "content"}}about{{end}}`),
+  }), private)
+  if err != nil {
+    t.Fatal(err)
+  }
+  bundle := buf.Bytes()
+
+  cache := TextCache()
+  if err := cache.Load(BundleReader(bytes.NewReader(bundle), int64(len(bundle)), public)); err != nil {
+    t.Fatal(err)
+  }
+  if str, err := cache.Builder("pages/home").ExecStr(); err != nil || str != "<home>" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+
+  reader := BundleReader(bytes.NewReader(bundle), int64(len(bundle)), public)
+  if content, err := reader.Read("pages/Home.tmpl"); err != nil || !strings.Contains(string(content), "home") {
+    t.Errorf("expected to read a template from the bundle, got %q %v", content, err)
+  }
+  tampered := rewriteBundle(t, bundle, "pages/Home.tmpl", []byte(`evil`))
+  var readErr *BundleError
+  _, err = BundleReader(bytes.NewReader(tampered), int64(len(tampered)), public).Read("pages/Home.tmpl")
+  if !errors.As(err, &readErr) || readErr.Reason != "does not match the hash in the manifest" {
+    t.Errorf("expected reading a tampered template to fail, got %v", err)
+  }
+
+  otherPublic, _, err := ed25519.GenerateKey(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    bundle []byte
+    key    ed25519.PublicKey
+    name   string
+    reason string
+  }{
+    {bundle, otherPublic, "", "signature is not valid"},
+    {
+      rewriteBundle(t, bundle, "pages/Home.tmpl", []byte(`{{extend "base"}}{{define "content"}}evil{{end}}`)),
+      public, "pages/Home", "does not match the hash in the manifest",
+    },
+    {rewriteBundle(t, bundle, "pages/Extra.tmpl", []byte(`extra`)), public, "pages/Extra", "is not in the manifest"},
+    {rewriteBundle(t, bundle, "pages/About.tmpl", nil), public, "pages/About", "is missing from the bundle"},
+    {rewriteBundle(t, bundle, BundleSignatureName, nil), public, "", "has no signature"},
+  }
+
+  for _, testData := range tests {
+    err := TextCache().Load(BundleReader(bytes.NewReader(testData.bundle), int64(len(testData.bundle)), testData.key))
+    var bundleErr *BundleError
+    if !errors.As(err, &bundleErr) {
+      t.Errorf("expected a bundle error, got %v", err)
+      continue
+    }
+    if bundleErr.Name != testData.name || bundleErr.Reason != testData.reason {
+      t.Errorf("expected %s to fail with %q, got %v", testData.name, testData.reason, err)
+    }
+  }
+}
+
+// Returns a copy of the bundle with the file at the given path replaced, or removed if content is nil, without
+// updating the manifest or signature.
+func rewriteBundle(t *testing.T, bundle []byte, path string, content []byte) []byte {
+  gzipReader, err := gzip.NewReader(bytes.NewReader(bundle))
+  if err != nil {
+    t.Fatal(err)
+  }
+  files := make(map[string][]byte)
+  var order []string
+  tarReader := tar.NewReader(gzipReader)
+  for {
+    header, err := tarReader.Next()
+    if err == io.EOF {
+      break
+    } else if err != nil {
+      t.Fatal(err)
+    }
+    data, err := ioutil.ReadAll(tarReader)
+    if err != nil {
+      t.Fatal(err)
+    }
+    files[header.Name] = data
+    order = append(order, header.Name)
+  }
+  if _, ok := files[path]; !ok {
+    order = append(order, path)
+  }
+  files[path] = content
+
+  buf := new(bytes.Buffer)
+  gzipWriter := gzip.NewWriter(buf)
+  tarWriter := tar.NewWriter(gzipWriter)
+  for _, name := range order {
+    if files[name] == nil {
+      continue
+    }
+    header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+    if err := tarWriter.WriteHeader(header); err != nil {
+      t.Fatal(err)
+    }
+    if _, err := tarWriter.Write(files[name]); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := tarWriter.Close(); err != nil {
+    t.Fatal(err)
+  }
+  if err := gzipWriter.Close(); err != nil {
+    t.Fatal(err)
+  }
+  return buf.Bytes()
+}
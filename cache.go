@@ -1,10 +1,17 @@
 package marmot
 
 import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
   "io"
   "path"
   "regexp"
   "strings"
+  "sync"
+  "sync/atomic"
+  "time"
   "unicode"
   "unicode/utf8"
 )
@@ -21,29 +28,166 @@ type Cache interface {
   //
   // Once this function returns, any exported templates in the FileCollection can be executed via Cache.Builder.
   // By default, exported templates are ones whose file name begins with a capital letter, but this behaviour can be
-  // overridden using Cache.WithExportRule.
+  // overridden using an ExportRule. Only the exported templates and the templates they extend or include are
+  // read; Cache.Validate checks the others as well.
+  //
+  // Templates can be executed while Load runs: they keep using the previously loaded templates until the new ones
+  // have all been parsed, at which point the new templates replace them all at once.
   Load(FileCollection) error
 
-  // Specifies a collection of functions which can be used in the templates.
+  // Resolves, reads and parses every template in the given FileCollection without loading them into the Cache,
+  // returning an ErrorList of every problem found rather than stopping at the first: duplicate template names and
+  // keys, missing dependencies, cycles and parse failures. Unexported templates are checked even if no exported
+  // template uses them, and each exported template is also parsed along with everything it extends and includes, as
+  // Cache.Load would parse it. With strict blocks, shadowed blocks are reported too. The templates currently loaded
+  // into the Cache are not affected.
+  Validate(FileCollection) error
+
+  // Specifies a collection of functions which can be used in the templates, from the next Cache.Load. The loaded
+  // templates keep their functions, and no new generation is created.
+  //
+  // Deprecated: pass Funcs to HTMLCache or TextCache, or to Cache.Reconfigure.
   WithFuncs(FuncMap) Cache
 
   // Specifies a custom export rule that is used to determine whether templates are exported or not; exported
   // templates can be executed via Cache.Builder, while unexported templates' only purpose is to be inherited from.
+  // The rule is used from the next Cache.Load, and no new generation is created.
+  //
+  // Deprecated: pass the ExportRule to HTMLCache or TextCache, or to Cache.Reconfigure.
   WithExportRule(ExportRule) Cache
 
+  // Applies the options to the Cache's configuration and, if any templates have been loaded, loads them again from
+  // the same FileCollection with the new configuration, as a new generation. If loading fails, the configuration
+  // and the loaded templates are left unchanged.
+  //
+  // The configuration a Cache is created with, or given by Cache.Reconfigure, is fixed for the templates loaded with
+  // it: Cache.Refresh, Cache.Mount and updates from a MemoryFiles rebuild templates with the configuration the
+  // current templates were loaded with.
+  Reconfigure(opts ...CacheOption) error
+
+  // Specifies whether blocks may be shadowed between included templates, as described by StrictBlocks, from the
+  // next Cache.Load. The loaded templates are not checked again, and no new generation is created.
+  //
+  // Deprecated: pass StrictBlocks to HTMLCache or TextCache, or to Cache.Reconfigure.
+  WithStrictBlocks(strict bool) Cache
+
+  // Specifies the maximum number of templates which are read and parsed concurrently, as described by Workers, from
+  // the next Cache.Load.
+  //
+  // Deprecated: pass Workers to HTMLCache or TextCache, or to Cache.Reconfigure.
+  WithWorkers(n int) Cache
+
+  // Specifies whether exported templates are compiled lazily, as described by LazyCompilation, from the next
+  // Cache.Load. The loaded templates are not compiled again, and no new generation is created.
+  //
+  // Deprecated: pass LazyCompilation to HTMLCache or TextCache, or to Cache.Reconfigure.
+  WithLazyCompilation(lazy bool) Cache
+
+  // Limits the number of lazily compiled templates kept by the Cache, and their total size in bytes, as described
+  // by CompileLimit.
+  //
+  // Deprecated: pass CompileLimit to HTMLCache or TextCache, or to Cache.Reconfigure.
+  WithCompileLimit(templates int, bytes int64) Cache
+
+  // Specifies how templates are named from their paths, and how the keys given to Cache.Builder find exported
+  // templates, from the next Cache.Load. The loaded templates keep their names and keys, and no new generation is
+  // created. By default, DefaultNameRule is used.
+  //
+  // Deprecated: pass the NameRule to HTMLCache or TextCache, or to Cache.Reconfigure.
+  WithNameRule(NameRule) Cache
+
   // Creates a new Builder for the template indexed by the given key.
   //
   // The key is the template's path in forward slash format minus its extension, case insensitive. If the
   // FileCollection used to load the templates was a Dir, then the paths should be relative to the path of the Dir.
+  // Both can be changed with a NameRule.
   //
   // For example, if you have a template templates/customer/Checkout.gohtml:
   //  _ = cache.Load(marmot.Directory("templates"))
   //  builder := cache.Builder("customer/checkout")
   Builder(key string) *Builder
 
-  exec(w io.Writer, key string, data DataMap) error
-  exportRule() ExportRule
-  functions() FuncMap
+  // Re-reads the templates with the given names from the FileCollection most recently passed to Cache.Load, and
+  // rebuilds only the exported templates which extend or include them. Templates which have been added to or
+  // removed from the FileCollection since it was loaded are picked up as well.
+  //
+  // Names are in the same format used by extend and include: the template's path in forward slash format minus its
+  // extension. If rebuilding fails, the previously loaded templates are kept.
+  //
+  // Templates are rebuilt with the configuration the current templates were loaded with, so a Cache.Load or
+  // Cache.Reconfigure is needed for a change of configuration to take effect.
+  Refresh(changed ...string) error
+
+  // Loads the templates in the given FileCollection under the prefix, alongside the templates already loaded, as if
+  // the collection had been wrapped with Namespace. If a collection is already mounted with the same prefix, it is
+  // replaced, and only its templates are read again. Exported templates are executed with keys starting with the
+  // prefix, such as cache.Builder("email/welcome") for the template welcome mounted with the prefix "email".
+  //
+  // Templates in one mount can extend and include templates in another by their full names, starting with "/":
+  //  {{extend "/web/layout"}}
+  //
+  // Templates loaded with Cache.Load are mounted with an empty prefix, and Cache.Load replaces every mount. A
+  // template name found in more than one mount is reported as a DuplicateTemplateError. If loading fails, the
+  // previously loaded templates are kept.
+  Mount(prefix string, fc FileCollection) error
+
+  // Removes the templates mounted with the given prefix by Cache.Mount, rebuilding any templates which used them.
+  Unmount(prefix string) error
+
+  // Specifies how many generations the Cache keeps, as described by History, from the next generation. The
+  // generations already kept are only dropped once the next generation is created.
+  //
+  // Deprecated: pass History to HTMLCache or TextCache, or to Cache.Reconfigure.
+  WithHistory(n int) Cache
+
+  // Returns the number of the current generation, or 0 if no templates have been loaded.
+  Generation() int
+
+  // Returns every generation the Cache has kept, oldest first.
+  Generations() []Generation
+
+  // Publishes the templates of the generation with the given number again as a new generation, which becomes
+  // current, so that Cache.Builder uses them. Returns a GenerationNotFoundError if the generation is no longer kept.
+  // The generations in between are still kept while the history allows, so a rollback can itself be undone with
+  // another Cache.Rollback, and Cache.Refresh rebuilds from the rolled back templates.
+  Rollback(generation int) error
+
+  // Loads the templates in the given FileCollection as shadow templates, which are rendered alongside the live
+  // templates without replacing them, to check a new version of the templates before it goes live. Loading shadow
+  // templates replaces any loaded before.
+  //
+  // Each execution of the live templates is also rendered with the shadow templates with the given probability,
+  // between 0 and 1. Shadow rendering happens in the background once the live execution has finished, and never
+  // delays it; if too many shadow executions are already running, the sample is skipped. Whenever the shadow output
+  // differs from the live output, or executing the shadow template fails, onDiff is called from a background
+  // goroutine. Builders pinned with Builder.WithGeneration are not sampled.
+  //
+  // Since shadow executions run after the live execution has returned, a sampled execution's data is still in use
+  // once Builder.Exec returns. The Builder's DataMap is copied, but the values in it are not, so they must not be
+  // modified after executing a template while shadow templates are loaded.
+  LoadShadow(fc FileCollection, rate float64, onDiff func(ShadowDiff)) error
+
+  // Makes the shadow templates loaded with Cache.LoadShadow live, as a new generation, and stops shadow rendering.
+  PromoteShadow() error
+
+  // Stops shadow rendering and discards the shadow templates loaded with Cache.LoadShadow, if there are any.
+  DiscardShadow()
+
+  // Returns the dependency graph of the templates currently loaded into the Cache. Templates which no exported
+  // template uses are read from the FileCollection the first time the graph of the loaded templates is needed, as
+  // described by Graph.
+  Graph() *Graph
+
+  // Returns every block used by the exported template with the given key, in alphabetical order, along with the
+  // template which supplies it and the definitions it shadowed.
+  Blocks(key string) ([]Block, error)
+
+  exec(w io.Writer, key string, generation int, data DataMap) error
+  load(FileCollection) (load int, err error)
+  refresh(load int, changed []string) error
+  resolve(FileCollection) (ResolvedFileCollection, error)
+  rebuildPaths(paths map[string]bool, staged map[*MemoryFiles]map[string][]byte) (prev, next *templateSet, err error)
+  swapSet(prev, next *templateSet) bool
 }
 
 type FuncMap map[string]interface{}
@@ -70,89 +214,810 @@ const (
 )
 
 type templateCreator interface {
-  Create(name, content string, funcs FuncMap) (templateCreator, error)
+  // Parses a template with the given name and content. The root templateCreator creates a new template configured
+  // with the cacheConfig; any other templateCreator adds the template to the ones it already holds, and is passed a
+  // nil cacheConfig.
+  Create(name, content string, config *cacheConfig) (templateCreator, error)
+  Clone() (templateCreator, error)
+  Execute(w io.Writer, data interface{}) error
 }
 
 type tpldata struct {
   content  []byte
+  hash     string
   extends  []string
   includes []string
+  blocks   *blockDefs
 }
 
+// The transitive dependencies of a template, in the order in which they are parsed.
+type dependencies struct {
+  extends  []string
+  includes []string
+}
+
+// A templateSet is the result of loading a FileCollection. Alongside the executable templates, it keeps the
+// directives of every template and the resolved dependency graph so that the set can be rebuilt incrementally.
+type templateSet struct {
+  files     ResolvedFileCollection
+  data      map[string]*tpldata
+  deps      map[string]*dependencies
+  stacks    map[string][]string
+  templates map[string]templateCreator
+  // The exported templates which have not been compiled by buildSet, indexed by key, if lazy compilation is enabled.
+  lazy     map[string]*lazyTemplate
+  nameRule NameRule
+  // The configuration the set was built with.
+  config *cacheConfig
+  // The number of the generation the set was published as, and when it was published. Both are zero until the set
+  // is published.
+  generation int
+  loaded     time.Time
+  // The number of the generation whose templates the set reuses, if it was published by Cache.Rollback.
+  rollbackOf int
+  // The number of the Cache.Load, or Cache.LoadShadow, whose FileCollection the set was built from. Sets rebuilt
+  // from the same collection keep the number, so that a Watcher can tell whether the Cache has since been loaded
+  // from another collection.
+  load int
+  // The templates which no exported template uses, read when the set's Graph is first needed.
+  unused *unusedTemplates
+  // If non-nil, resolveDependencies records missing dependencies and cycles here and carries on without them,
+  // rather than returning the first one.
+  problems *ErrorList
+}
+
+// The regular expressions matching the extend and include directives with the default delimiters. Caches configured
+// with other delimiters use ones built by directiveRegexp instead.
 var (
   reExtend  = regexp.MustCompile(`(?s){{\s*extend(\s[^{}]*}}|}})(\s*(\r\n|\r|\n))*`)
   reInclude = regexp.MustCompile(`(?s){{\s*include(\s[^{}]*}}|}})(\s*(\r\n|\r|\n))*`)
   reString  = regexp.MustCompile(`"([^"\\]|\\.)*"`)
+
+  // Line breaks as the directive regular expressions match them.
+  reLineBreak = regexp.MustCompile(`\r\n|\r|\n`)
 )
 
-func createTemplates(cache Cache, fc FileCollection, root templateCreator) (map[string]templateCreator, error) {
-  tcs := make(map[string]templateCreator)
-  data := make(map[string]*tpldata)
-  files, err := fc.Resolve()
+// The Cache implementation shared by HTMLCache and TextCache; the two only differ in the root templateCreator.
+//
+// The current templateSet is never modified once it has been built, and is published through an atomic.Value so
+// that executing a template never waits for a load. Loads are serialised by the update lock, and build the new set
+// before publishing it. The sets of earlier generations are kept in sets, which is replaced rather than modified.
+// The cacheConfig is likewise replaced rather than modified, under the update lock.
+type templateCache struct {
+  update     sync.Mutex
+  current    atomic.Value
+  sets       atomic.Value
+  config     atomic.Value
+  generation int
+  loads      int
+  root       templateCreator
+  compiled   *compiledTemplates
+  shadow     atomic.Value
+}
+
+// Creates a new templateCache with the given options, panicking if any of them are invalid, in the same way as
+// text/template's Template.Option.
+func newTemplateCache(root templateCreator, opts ...CacheOption) *templateCache {
+  config, err := newCacheConfig().with(opts...)
   if err != nil {
-    return nil, err
+    panic(err)
   }
-  var exportRule ExportRule
-  if customRule := cache.exportRule(); customRule != nil {
-    exportRule = customRule
-  } else {
+  c := &templateCache{
+    root:     root,
+    compiled: newCompiledTemplates(),
+  }
+  c.storeConfig(config)
+  c.current.Store(&templateSet{
+    templates: make(map[string]templateCreator),
+    nameRule:  config.nameRule,
+    config:    config,
+  })
+  return c
+}
+
+// Returns the current configuration, which is used by the next Cache.Load.
+func (c *templateCache) configuration() *cacheConfig {
+  return c.config.Load().(*cacheConfig)
+}
+
+// Returns the configuration to rebuild the set with incrementally, which is the one it was built with unless no
+// templates have been loaded yet.
+func (c *templateCache) configFor(set *templateSet) *cacheConfig {
+  if set.files.FileCollection == nil {
+    return c.configuration()
+  }
+  return set.config
+}
+
+// Applies the options to the current configuration, which takes effect from the next Cache.Load. Only an invalid
+// Option can make it fail, so the deprecated setters, which never pass one, ignore the error.
+func (c *templateCache) configure(opts ...CacheOption) error {
+  c.update.Lock()
+  defer c.update.Unlock()
+  config, err := c.configuration().with(opts...)
+  if err != nil {
+    return err
+  }
+  c.storeConfig(config)
+  return nil
+}
+
+// Replaces the current configuration, applying its compile limits straight away. Once the Cache is in use, the
+// update lock must be held.
+func (c *templateCache) storeConfig(config *cacheConfig) {
+  c.config.Store(config)
+  c.compiled.setLimits(config.maxTemplates, config.maxBytes)
+}
+
+// Returns the most recently published templateSet.
+func (c *templateCache) set() *templateSet {
+  return c.current.Load().(*templateSet)
+}
+
+func (c *templateCache) Load(fc FileCollection) error {
+  _, err := c.load(fc)
+  return err
+}
+
+// Loads the templates as Cache.Load does, returning the number of the load, which the sets rebuilt from the same
+// FileCollection keep.
+func (c *templateCache) load(fc FileCollection) (int, error) {
+  c.update.Lock()
+  defer c.update.Unlock()
+  config := c.configuration()
+  files, err := resolveWith(fc, resolution{rule: config.nameRule})
+  if err != nil {
+    return 0, err
+  }
+  set, err := c.buildSet(files, nil, nil, config)
+  if err != nil {
+    return 0, err
+  }
+  c.loads++
+  set.load = c.loads
+  c.publish(set)
+  return set.load, nil
+}
+
+func (c *templateCache) Refresh(changed ...string) error {
+  return c.refresh(0, changed)
+}
+
+// Refreshes the templates as Cache.Refresh does, but only if the current templates were built from the load with
+// the given number, doing nothing otherwise. A load of 0 refreshes the templates wherever they were loaded from.
+func (c *templateCache) refresh(load int, changed []string) error {
+  c.update.Lock()
+  defer c.update.Unlock()
+  prev := c.set()
+  if prev.files.FileCollection == nil {
+    return fmt.Errorf("cannot refresh templates before any have been loaded")
+  }
+  if load != 0 && prev.load != load {
+    return nil
+  }
+  files, err := resolveWith(prev.files.FileCollection, resolution{rule: prev.config.nameRule})
+  if err != nil {
+    return err
+  }
+  changedSet := make(map[string]bool)
+  for _, name := range changed {
+    changedSet[name] = true
+  }
+  set, err := c.buildSet(files, prev, changedSet, prev.config)
+  if err != nil {
+    return err
+  }
+  c.publish(set)
+  return nil
+}
+
+// Rebuilds the templates as Cache.Refresh does, treating the templates whose files have the given paths as changed,
+// but returns the new set rather than replacing the current one. Any MemoryFiles in staged are resolved with the
+// staged files rather than their current ones. If no templates have been loaded, next is nil.
+func (c *templateCache) rebuildPaths(
+  paths map[string]bool, staged map[*MemoryFiles]map[string][]byte,
+) (prev, next *templateSet, err error) {
+  c.update.Lock()
+  defer c.update.Unlock()
+  prev = c.set()
+  if prev.files.FileCollection == nil {
+    return prev, nil, nil
+  }
+  files, err := resolveWith(prev.files.FileCollection, resolution{rule: prev.config.nameRule, staged: staged})
+  if err != nil {
+    return nil, nil, err
+  }
+  changed := make(map[string]bool)
+  for _, fc := range []ResolvedFileCollection{prev.files, files} {
+    for name, path := range fc.Paths {
+      if paths[path] || paths[fc.sourcePath(name)] {
+        changed[name] = true
+      }
+    }
+  }
+  next, err = c.buildSet(files, prev, changed, prev.config)
+  if err != nil {
+    return nil, nil, err
+  }
+  return prev, next, nil
+}
+
+// Replaces the current set with next, unless the current set is no longer prev because the Cache has been loaded
+// since prev was current.
+func (c *templateCache) swapSet(prev, next *templateSet) bool {
+  c.update.Lock()
+  defer c.update.Unlock()
+  if c.set() != prev {
+    return false
+  }
+  c.publish(next)
+  return true
+}
+
+func (c *templateCache) Validate(fc FileCollection) error {
+  config := c.configuration()
+  files, duplicates, err := resolveAll(fc, resolution{rule: config.nameRule})
+  if err != nil {
+    return ErrorList{err}
+  }
+
+  problems := ErrorList(duplicates)
+  set := &templateSet{
+    files:    files,
+    data:     make(map[string]*tpldata),
+    deps:     make(map[string]*dependencies),
+    nameRule: config.nameRule,
+    config:   config,
+    problems: &problems,
+  }
+  if err := set.checkKeys(config.export); err != nil {
+    problems = append(problems, err)
+  }
+
+  names := files.templateNames()
+  read := make([]tpldata, len(names))
+  readErrs := make([]error, len(names))
+  _ = parallel(config.workers, len(names), func(i int) error {
+    read[i], readErrs[i] = loadTemplate(files, names[i], config)
+    return nil
+  })
+  for i, name := range names {
+    // Templates which could not be read are still added, with no content, so that they are not also reported as
+    // missing by the templates which depend on them.
+    set.data[name] = &read[i]
+    if readErrs[i] != nil {
+      problems = append(problems, readErrs[i])
+    }
+  }
+
+  parseErrs := make([]error, len(names))
+  _ = parallel(config.workers, len(names), func(i int) error {
+    name := names[i]
+    if _, err := c.root.Create(name, string(set.data[name].content), config); err != nil {
+      parseErrs[i] = set.errParse(name, err)
+    }
+    return nil
+  })
+  for _, err := range parseErrs {
+    if err != nil {
+      problems = append(problems, err)
+    }
+  }
+
+  for _, name := range names {
+    if err := set.resolveDependencies(name, nil); err != nil {
+      problems = append(problems, err)
+    }
+  }
+
+  // Templates which parse on their own can still fail to parse together, so each exported template's whole stack is
+  // parsed as well. Stacks containing a template which could not be read or parsed on its own are skipped, since
+  // the problem has already been reported.
+  broken := make(map[string]bool)
+  for i, name := range names {
+    broken[name] = readErrs[i] != nil || parseErrs[i] != nil
+  }
+  exportRule := config.export
+  if exportRule == nil {
     exportRule = defaultExportRule
   }
-  funcs := cache.functions()
+  isBroken := func(stack []string) bool {
+    for _, name := range stack {
+      if broken[name] {
+        return true
+      }
+    }
+    return false
+  }
+  set.stacks = make(map[string][]string)
+  var exported []string
   for _, name := range files.Names {
-    if tplType := exportRule(name); tplType == Exported {
-      data, err := recurseTemplates(files, data, name)
-      if err != nil {
-        return nil, err
+    if _, ok := set.deps[name]; !ok || exportRule(name) != Exported {
+      continue
+    }
+    if stack := set.stack(name); !isBroken(stack) {
+      set.stacks[name] = stack
+      exported = append(exported, name)
+    }
+  }
+  stackErrs := make([]error, len(exported))
+  _ = parallel(config.workers, len(exported), func(i int) error {
+    name := exported[i]
+    if _, err := c.parseStack(set, set.stacks[name]); err != nil {
+      stackErrs[i] = err.withTemplate(name)
+    } else if config.strict {
+      stackErrs[i] = set.checkShadowing(name)
+    }
+    return nil
+  })
+  for _, err := range stackErrs {
+    if err != nil {
+      problems = append(problems, err)
+    }
+  }
+
+  if len(problems) > 0 {
+    return problems
+  }
+  return nil
+}
+
+func (c *templateCache) WithFuncs(funcs FuncMap) Cache {
+  _ = c.configure(Funcs(funcs))
+  return c
+}
+
+func (c *templateCache) WithExportRule(rule ExportRule) Cache {
+  _ = c.configure(rule)
+  return c
+}
+
+func (c *templateCache) WithStrictBlocks(strict bool) Cache {
+  _ = c.configure(StrictBlocks(strict))
+  return c
+}
+
+func (c *templateCache) WithWorkers(n int) Cache {
+  _ = c.configure(Workers(n))
+  return c
+}
+
+func (c *templateCache) WithNameRule(rule NameRule) Cache {
+  _ = c.configure(rule)
+  return c
+}
+
+func (c *templateCache) Builder(key string) *Builder {
+  return &Builder{cache: c, key: key, data: make(map[string]interface{})}
+}
+
+func (c *templateCache) Graph() *Graph {
+  set := c.set()
+  return newGraph(set)
+}
+
+func (c *templateCache) Blocks(key string) ([]Block, error) {
+  set := c.set()
+  for name := range set.stacks {
+    if set.nameRule.key(name) == set.nameRule.key(key) {
+      return set.resolveBlocks(name)
+    }
+  }
+  return nil, &TemplateNotFoundError{Key: key}
+}
+
+func (c *templateCache) exec(w io.Writer, key string, generation int, data DataMap) error {
+  set, err := c.generationSet(generation)
+  if err != nil {
+    return err
+  }
+  shadow := c.sampleShadow(generation)
+  if shadow == nil {
+    return c.execSet(w, set, key, data)
+  }
+  live := new(bytes.Buffer)
+  if err := c.execSet(io.MultiWriter(w, live), set, key, data); err != nil {
+    return err
+  }
+  shadow.render(c, key, data, live.String())
+  return nil
+}
+
+// Executes the template with the given key from the set.
+func (c *templateCache) execSet(w io.Writer, set *templateSet, key string, data DataMap) error {
+  tpl, ok := set.templates[set.nameRule.key(key)]
+  if !ok {
+    var err error
+    if tpl, ok, err = c.compile(set, key); err != nil {
+      return err
+    } else if !ok {
+      return &TemplateNotFoundError{Key: key}
+    }
+  }
+  if err := tpl.Execute(w, data); err != nil {
+    return set.errExec(key, err)
+  }
+  return nil
+}
+
+// Resolves the FileCollection, naming its templates with the NameRule the current templates were loaded with.
+func (c *templateCache) resolve(fc FileCollection) (ResolvedFileCollection, error) {
+  return resolveWith(fc, resolution{rule: c.configFor(c.set()).nameRule})
+}
+
+// Builds a new templateSet from the given files. If prev is non-nil, the new set is built incrementally from it:
+// only the templates named in changed, along with any templates which have been added or moved since prev was
+// built, are read again, and only the exported templates whose stack contains one of them are parsed again.
+func (c *templateCache) buildSet(
+  files ResolvedFileCollection, prev *templateSet, changed map[string]bool, config *cacheConfig,
+) (*templateSet, error) {
+  set := &templateSet{
+    files:     files,
+    data:      make(map[string]*tpldata),
+    deps:      make(map[string]*dependencies),
+    stacks:    make(map[string][]string),
+    templates: make(map[string]templateCreator),
+    nameRule:  config.nameRule,
+    config:    config,
+    unused:    &unusedTemplates{},
+  }
+  if prev != nil {
+    set.load = prev.load
+  }
+  if err := set.checkKeys(config.export); err != nil {
+    return nil, err
+  }
+  if err := set.readTemplates(prev, changed, config.export); err != nil {
+    return nil, err
+  }
+  if err := set.resolveStacks(config.export); err != nil {
+    return nil, err
+  }
+  if config.strict {
+    for _, name := range files.Names {
+      if _, ok := set.stacks[name]; !ok {
+        continue
       }
-      templateStack, i := make([]string, 1+len(data[name].extends)+len(data[name].includes)), 0
-      for _, parent := range data[name].extends {
-        templateStack[i] = parent
-        i++
+      if err := set.checkShadowing(name); err != nil {
+        return nil, err
       }
-      templateStack[i] = name
-      i++
-      for _, included := range data[name].includes {
-        templateStack[i] = included
-        i++
+    }
+  }
+  if config.lazy {
+    set.prepareLazy(prev, changed)
+    return set, nil
+  }
+  if err := c.parseTemplates(set, prev, changed); err != nil {
+    return nil, err
+  }
+  return set, nil
+}
+
+// Reads the exported templates, then the templates they extend and include, and so on, so that templates which no
+// exported template uses are never read. The data of templates which have not changed since prev is reused.
+// Templates which are used but missing from the FileCollection are left for resolveDependencies to report.
+func (set *templateSet) readTemplates(prev *templateSet, changed map[string]bool, exportRule ExportRule) error {
+  if exportRule == nil {
+    exportRule = defaultExportRule
+  }
+  queued := make(map[string]bool)
+  var next []string
+  enqueue := func(name string) {
+    if _, ok := set.files.Paths[name]; ok && !queued[name] {
+      queued[name] = true
+      next = append(next, name)
+    }
+  }
+  for _, name := range set.files.Names {
+    if exportRule(name) == Exported {
+      enqueue(name)
+    }
+  }
+
+  // Each round reads the templates found by the round before, in parallel.
+  for len(next) > 0 {
+    round := next
+    next = nil
+    var toRead []string
+    for _, name := range round {
+      if prev != nil && !changed[name] && prev.files.Paths[name] == set.files.Paths[name] &&
+        prev.files.Shadows[name] == set.files.Shadows[name] {
+        if data, ok := prev.data[name]; ok {
+          set.data[name] = data
+          continue
+        }
       }
-      tpl, err := root.Create(templateStack[0], string(data[templateStack[0]].content), funcs)
-      if err != nil {
-        return nil, err
+      toRead = append(toRead, name)
+    }
+
+    read := make([]tpldata, len(toRead))
+    err := parallel(set.config.workers, len(toRead), func(i int) (err error) {
+      read[i], err = loadTemplate(set.files, toRead[i], set.config)
+      return err
+    })
+    if err != nil {
+      return err
+    }
+    for i, name := range toRead {
+      set.data[name] = &read[i]
+      if prev != nil {
+        changed[name] = true
       }
-      for j := 1; j < len(templateStack); j++ {
-        _, err := tpl.Create(templateStack[j], string(data[templateStack[j]].content), nil)
-        if err != nil {
-          return nil, err
+    }
+
+    for _, name := range round {
+      for _, deps := range [][]string{set.data[name].extends, set.data[name].includes} {
+        for _, dep := range deps {
+          enqueue(dep)
         }
       }
-      tcs[templateKey(name)] = tpl
     }
   }
-  return tcs, nil
+
+  if prev != nil {
+    for name := range prev.data {
+      if _, ok := set.data[name]; !ok {
+        changed[name] = true
+      }
+    }
+  }
+
+  return nil
+}
+
+// Returns an error if two exported templates have the same key, in which case one would replace the other.
+func (set *templateSet) checkKeys(exportRule ExportRule) error {
+  if exportRule == nil {
+    exportRule = defaultExportRule
+  }
+  keys := make(map[string]string)
+  for _, name := range set.files.Names {
+    if exportRule(name) != Exported {
+      continue
+    }
+    key := set.nameRule.key(name)
+    if dup, ok := keys[key]; ok {
+      return &DuplicateKeyError{
+        Key:           key,
+        Name:          dup,
+        Path:          set.files.Paths[dup],
+        DuplicateName: name,
+        DuplicatePath: set.files.Paths[name],
+      }
+    }
+    keys[key] = name
+  }
+  return nil
+}
+
+func (set *templateSet) resolveStacks(exportRule ExportRule) error {
+  if exportRule == nil {
+    exportRule = defaultExportRule
+  }
+  for _, name := range set.files.Names {
+    if exportRule(name) != Exported {
+      continue
+    }
+    if err := set.resolveDependencies(name, nil); err != nil {
+      return err
+    }
+    set.stacks[name] = set.stack(name)
+  }
+  return nil
+}
+
+func (c *templateCache) parseTemplates(set *templateSet, prev *templateSet, changed map[string]bool) error {
+  var toParse []string
+  var parentKeys []string
+  parents := make(map[string]*parentSet)
+  for _, name := range set.files.Names {
+    stack, ok := set.stacks[name]
+    if !ok {
+      continue
+    }
+    key := set.nameRule.key(name)
+    if prev != nil && !stackChanged(prev.stacks[name], stack, changed) {
+      if tpl, ok := prev.templates[key]; ok {
+        set.templates[key] = tpl
+        continue
+      }
+    }
+    toParse = append(toParse, name)
+    if extends := set.deps[name].extends; len(extends) > 0 {
+      parentKey := strings.Join(extends, "\x00")
+      if _, ok := parents[parentKey]; !ok {
+        parents[parentKey] = &parentSet{stack: extends}
+        parentKeys = append(parentKeys, parentKey)
+      }
+    }
+  }
+
+  // Errors from parsing a parent set are not returned here but by the first template to use the parent set, which
+  // keeps the error returned the same as when the templates are parsed one at a time.
+  _ = parallel(set.config.workers, len(parentKeys), func(i int) error {
+    parent := parents[parentKeys[i]]
+    parent.template, parent.err = c.parseStack(set, parent.stack)
+    return nil
+  })
+
+  parsed := make([]templateCreator, len(toParse))
+  err := parallel(set.config.workers, len(toParse), func(i int) (err error) {
+    parsed[i], err = c.buildTemplate(set, toParse[i], parents)
+    return err
+  })
+  if err != nil {
+    return err
+  }
+
+  for i, name := range toParse {
+    set.templates[set.nameRule.key(name)] = parsed[i]
+  }
+  return nil
+}
+
+// A parentSet is the template produced by parsing the shared ancestors of one or more exported templates.
+type parentSet struct {
+  stack    []string
+  template templateCreator
+  err      *ParseError
+}
+
+// Builds the executable template for the named exported template.
+//
+// The template's ancestors are parsed once into a parent set, which is shared by every template with the same
+// ancestors. Each template is then parsed, along with its own includes, into a clone of its parent set.
+func (c *templateCache) buildTemplate(
+  set *templateSet, name string, parents map[string]*parentSet,
+) (templateCreator, error) {
+  extends, stack := set.deps[name].extends, set.stacks[name]
+  if len(extends) == 0 {
+    tpl, err := c.parseStack(set, stack)
+    if err != nil {
+      return nil, err.withTemplate(name)
+    }
+    return tpl, nil
+  }
+  parent := parents[strings.Join(extends, "\x00")]
+  if parent.err != nil {
+    return nil, parent.err.withTemplate(name)
+  }
+  tpl, err := parent.template.Clone()
+  if err != nil {
+    return nil, err
+  }
+  for _, dep := range stack[len(extends):] {
+    if _, err := tpl.Create(dep, string(set.data[dep].content), nil); err != nil {
+      return nil, set.errParse(dep, err).withTemplate(name)
+    }
+  }
+  return tpl, nil
+}
+
+// Parses each of the templates in the stack, in order, into a new template.
+func (c *templateCache) parseStack(set *templateSet, stack []string) (templateCreator, *ParseError) {
+  tpl, err := c.root.Create(stack[0], string(set.data[stack[0]].content), set.config)
+  if err != nil {
+    return nil, set.errParse(stack[0], err)
+  }
+  for _, name := range stack[1:] {
+    if _, err := tpl.Create(name, string(set.data[name].content), nil); err != nil {
+      return nil, set.errParse(name, err)
+    }
+  }
+  return tpl, nil
+}
+
+func (set *templateSet) errParse(name string, err error) *ParseError {
+  parseErr := &ParseError{Name: name, Path: set.files.Paths[name], Err: err}
+  if _, line, description, ok := splitTemplateError(err); ok {
+    parseErr.Line, parseErr.Description = line, description
+  }
+  return parseErr
+}
+
+func (set *templateSet) errExec(key string, err error) *ExecError {
+  execErr := &ExecError{Key: key, Err: err}
+  if name, line, description, ok := splitTemplateError(err); ok {
+    execErr.Name, execErr.Line, execErr.Description = name, line, description
+    execErr.Path = set.files.Paths[name]
+  }
+  return execErr
+}
+
+// Returns a copy of the error which records the exported template being built when it occurred. Parent sets are
+// shared between exported templates, so their errors are copied rather than modified.
+func (e *ParseError) withTemplate(name string) *ParseError {
+  withTemplate := *e
+  withTemplate.Template = name
+  return &withTemplate
+}
+
+// Returns the names of the templates which must be parsed, in order, to build the given template: its ancestors
+// and their includes, then the template itself, then its own includes.
+func (set *templateSet) stack(name string) []string {
+  deps := set.deps[name]
+  stack := make([]string, 0, 1+len(deps.extends)+len(deps.includes))
+  stack = append(stack, deps.extends...)
+  stack = append(stack, name)
+  return append(stack, deps.includes...)
+}
+
+func stackChanged(prevStack, stack []string, changed map[string]bool) bool {
+  if len(prevStack) != len(stack) {
+    return true
+  }
+  for i, name := range stack {
+    if prevStack[i] != name || changed[name] {
+      return true
+    }
+  }
+  return false
 }
 
-func loadTemplate(fc ResolvedFileCollection, name string) (data tpldata, err error) {
+func loadTemplate(fc ResolvedFileCollection, name string, config *cacheConfig) (data tpldata, err error) {
   content, err := fc.Read(name)
   if err != nil {
     return data, err
   }
+  hash := sha256.Sum256(content)
+  data.hash = hex.EncodeToString(hash[:])
 
-  if match := reExtend.FindIndex(content); match != nil {
+  if match := config.reExtend.FindIndex(content); match != nil {
     data.extends = parseDependencies(strings.TrimSpace(string(content[match[0]:match[1]])))
-    content = append(content[:match[0]], content[match[1]:]...)
+    content = stripDirective(content, match, config)
   }
 
-  if match := reInclude.FindIndex(content); match != nil {
+  if match := config.reInclude.FindIndex(content); match != nil {
     data.includes = parseDependencies(strings.TrimSpace(string(content[match[0]:match[1]])))
-    content = append(content[:match[0]], content[match[1]:]...)
+    content = stripDirective(content, match, config)
+  }
+
+  if namespace := fc.namespaces[name]; namespace != "" {
+    for _, deps := range [][]string{data.extends, data.includes} {
+      for i, dep := range deps {
+        deps[i] = qualifyName(namespace, dep)
+      }
+    }
+  } else {
+    for _, deps := range [][]string{data.extends, data.includes} {
+      for i, dep := range deps {
+        deps[i] = strings.TrimPrefix(dep, "/")
+      }
+    }
+  }
+
+  // A template which extends or includes its own name means the template it shadows, if there is one.
+  if hidden, ok := fc.Shadows[name]; ok {
+    own := fc.visibleName(name)
+    for _, deps := range [][]string{data.extends, data.includes} {
+      for i, dep := range deps {
+        if dep == own {
+          deps[i] = hidden
+        }
+      }
+    }
   }
 
   data.content = content
+  data.blocks = &blockDefs{}
 
   return data, nil
 }
 
+// Removes the directive at the given match from the content. If the directive spans multiple lines, it is replaced
+// with a comment containing the same line breaks, whether they are "\r\n", "\r" or "\n", so that the line numbers
+// reported by the template parser still match the original file. The comment uses the delimiters of the
+// configuration.
+func stripDirective(content []byte, match []int, config *cacheConfig) []byte {
+  stripped := append([]byte(nil), content[:match[0]]...)
+  if breaks := reLineBreak.FindAll(content[match[0]:match[1]], -1); len(breaks) > 0 {
+    stripped = append(stripped, config.leftDelim()+"/*"...)
+    stripped = append(stripped, bytes.Join(breaks, nil)...)
+    stripped = append(stripped, "*/"+config.rightDelim()...)
+  }
+  return append(stripped, content[match[1]:]...)
+}
+
 func parseDependencies(dependencyStatement string) []string {
   var dependencies []string
   for _, str := range reString.FindAllString(dependencyStatement, -1) {
@@ -163,70 +1028,104 @@ func parseDependencies(dependencyStatement string) []string {
   return dependencies
 }
 
-func recurseTemplates(fc ResolvedFileCollection, data map[string]*tpldata, name string) (map[string]*tpldata, error) {
-  if _, ok := data[name]; ok {
-    return data, nil
+// Resolves the transitive dependencies of the named template and of everything it depends on, storing them in
+// set.deps. The chain is the list of templates currently being resolved which led to this one, and is used to
+// detect cycles.
+func (set *templateSet) resolveDependencies(name string, chain []string) error {
+  for i, ancestor := range chain {
+    if ancestor == name {
+      return set.errCycle(append(chain[i:len(chain):len(chain)], name))
+    }
   }
 
-  tplData, err := loadTemplate(fc, name)
-  if err != nil {
-    return data, err
+  if _, ok := set.deps[name]; ok {
+    return nil
   }
 
-  data[name] = &tplData
+  tplData, ok := set.data[name]
+  if !ok {
+    err := &MissingDependencyError{Name: name}
+    if len(chain) > 0 {
+      err.ReferencedBy = chain[len(chain)-1]
+      err.Path = set.files.Paths[err.ReferencedBy]
+    }
+    return err
+  }
 
-  dependencies := make(map[string]bool)
+  chain = append(chain[:len(chain):len(chain)], name)
+  seen := make(map[string]bool)
   var extends, includes []string
 
   for _, parent := range tplData.extends {
-    data, err = recurseTemplates(fc, data, parent)
-    if err != nil {
-      return data, err
+    if err := set.resolveDependencies(parent, chain); err != nil {
+      if !set.report(err) {
+        return err
+      }
+      continue
     }
 
-    for _, dep := range data[parent].extends {
-      if !dependencies[dep] {
-        extends, dependencies[dep] = append(extends, dep), true
+    for _, dep := range set.deps[parent].extends {
+      if !seen[dep] {
+        extends, seen[dep] = append(extends, dep), true
       }
     }
 
-    if !dependencies[parent] {
-      extends, dependencies[parent] = append(extends, parent), true
+    if !seen[parent] {
+      extends, seen[parent] = append(extends, parent), true
     }
 
-    for _, dep := range data[parent].includes {
-      if !dependencies[dep] {
-        extends, dependencies[dep] = append(extends, dep), true
+    for _, dep := range set.deps[parent].includes {
+      if !seen[dep] {
+        extends, seen[dep] = append(extends, dep), true
       }
     }
   }
 
   for _, included := range tplData.includes {
-    data, err = recurseTemplates(fc, data, included)
-    if err != nil {
-      return data, err
+    if err := set.resolveDependencies(included, chain); err != nil {
+      if !set.report(err) {
+        return err
+      }
+      continue
     }
 
-    for _, dep := range data[included].extends {
-      if !dependencies[dep] {
-        includes, dependencies[dep] = append(includes, dep), true
+    for _, dep := range set.deps[included].extends {
+      if !seen[dep] {
+        includes, seen[dep] = append(includes, dep), true
       }
     }
 
-    if !dependencies[included] {
-      includes, dependencies[included] = append(includes, included), true
+    if !seen[included] {
+      includes, seen[included] = append(includes, included), true
     }
 
-    for _, dep := range data[included].includes {
-      if !dependencies[dep] {
-        includes, dependencies[dep] = append(includes, dep), true
+    for _, dep := range set.deps[included].includes {
+      if !seen[dep] {
+        includes, seen[dep] = append(includes, dep), true
       }
     }
   }
 
-  tplData.extends, tplData.includes = extends, includes
+  set.deps[name] = &dependencies{extends: extends, includes: includes}
 
-  return data, err
+  return nil
+}
+
+// Records a missing dependency or cycle if the set is collecting them, returning whether it did so.
+func (set *templateSet) report(err error) bool {
+  if set.problems == nil {
+    return false
+  }
+  *set.problems = append(*set.problems, err)
+  return true
+}
+
+func (set *templateSet) errCycle(cycle []string) error {
+  paths := make([]string, len(cycle))
+  for i, name := range cycle {
+    paths[i] = set.files.Paths[name]
+  }
+  return &CycleError{Chain: cycle, Paths: paths}
 }
 
 func defaultExportRule(name string) TemplateType {
@@ -235,7 +1134,3 @@ func defaultExportRule(name string) TemplateType {
   }
   return Unexported
 }
-
-func templateKey(name string) string {
-  return strings.ToLower(name)
-}
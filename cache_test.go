@@ -0,0 +1,411 @@
+package marmot
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+)
+
+func TestRefresh(t *testing.T) {
+  files := map[string][]byte{
+    "base.tmpl":   []byte(`{{template "header" .}} {{template "content" .}}`),
+    "header.tmpl": []byte(`{{define "header"}}Header{{end}}`),
+    "nav.tmpl":    []byte(`{{define "nav"}}Nav{{end}}`),
+    "Home.tmpl":   []byte(`{{extend "base"}}{{include "header"}}{{define "content"}}Home{{end}}`),
+    "About.tmpl": []byte(
+      `{{extend "base"}}{{include "header nav"}}{{define "content"}}About {{template "nav"}}{{end}}`,
+    ),
+  }
+
+  cache := TextCache()
+  if err := cache.Load(PreloadedFiles(files)); err != nil {
+    t.Fatal(err)
+  }
+
+  expect := func(key, output string) {
+    str, err := cache.Builder(key).ExecStr()
+    if err != nil {
+      t.Error(err)
+    } else if strings.TrimSpace(str) != output {
+      t.Errorf("expected %q for %s, got %q", output, key, str)
+    }
+  }
+
+  expect("home", "Header Home")
+  expect("about", "Header About Nav")
+
+  home := cache.(*templateCache).set().templates["home"]
+
+  files["nav.tmpl"] = []byte(`{{define "nav"}}Navigation{{end}}`)
+  if err := cache.Refresh("nav"); err != nil {
+    t.Fatal(err)
+  }
+
+  expect("home", "Header Home")
+  expect("about", "Header About Navigation")
+
+  if cache.(*templateCache).set().templates["home"] != home {
+    t.Error("template unaffected by refresh was rebuilt")
+  }
+
+  files["Contact.tmpl"] = []byte(`{{extend "base"}}{{include "header"}}{{define "content"}}Contact{{end}}`)
+  files["nav.tmpl"] = []byte(`{{define "nav"}}{{end`)
+  if err := cache.Refresh("nav"); err == nil {
+    t.Error("expected refresh to fail")
+  }
+
+  expect("about", "Header About Navigation")
+  if _, err := cache.Builder("contact").ExecStr(); err == nil {
+    t.Error("expected contact to be missing after failed refresh")
+  }
+
+  files["nav.tmpl"] = []byte(`{{define "nav"}}Nav{{end}}`)
+  if err := cache.Refresh("nav"); err != nil {
+    t.Fatal(err)
+  }
+
+  expect("about", "Header About Nav")
+  expect("contact", "Header Contact")
+}
+
+func TestUnusedTemplatesNotRead(t *testing.T) {
+  // unused.tmpl does not exist, but no exported template uses it, so it is never read.
+  cache := TextCache(Funcs(Std()))
+  err := cache.Load(Paths("testdata/text", "Smolbotbot.tmpl", "base.tmpl", "greeting.tmpl", "unused.tmpl"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := cache.(*templateCache).set().data["unused"]; ok {
+    t.Error("expected unused template not to be read")
+  }
+  graph := cache.Graph()
+  if path := graph.Path("unused"); path == "" || graph.Extends("unused") != nil {
+    t.Errorf("expected unused template in the graph with no dependencies, got %q %v", path, graph.Extends("unused"))
+  }
+}
+
+func TestSharedParents(t *testing.T) {
+  cache := HTMLCache()
+  if err := cache.Load(benchmarkFiles(3)); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 3; i++ {
+    str, err := cache.Builder(fmt.Sprintf("page%d", i)).
+      With("Title", "Marmots").
+      With("Links", []string{"/home"}).
+      With("Body", "<b>").
+      ExecStr()
+    if err != nil {
+      t.Fatal(err)
+    }
+    expect := fmt.Sprintf(`<h1>Page %d</h1><p>&lt;b&gt;</p>`, i)
+    if !strings.Contains(str, expect) || !strings.Contains(str, `<title>Marmots</title>`) {
+      t.Errorf("incorrect html output for page%d: %s", i, str)
+    }
+  }
+}
+
+func TestCycles(t *testing.T) {
+  tests := []struct {
+    files map[string][]byte
+    chain string
+  }{
+    {
+      map[string][]byte{
+        "A.tmpl": []byte(`{{extend "b"}}`),
+        "b.tmpl": []byte(`{{extend "A"}}`),
+      },
+      "A (A.tmpl) -> b (b.tmpl) -> A (A.tmpl)",
+    },
+    {
+      map[string][]byte{
+        "Page.tmpl":  []byte(`{{extend "base"}}`),
+        "base.tmpl":  []byte(`{{include "nav"}}`),
+        "nav.tmpl":   []byte(`{{include "links"}}`),
+        "links.tmpl": []byte(`{{extend "nav"}}`),
+      },
+      "nav (nav.tmpl) -> links (links.tmpl) -> nav (nav.tmpl)",
+    },
+    {
+      map[string][]byte{
+        "Page.tmpl": []byte(`{{include "Page"}}`),
+      },
+      "Page (Page.tmpl) -> Page (Page.tmpl)",
+    },
+  }
+
+  for _, testData := range tests {
+    err := TextCache().Load(PreloadedFiles(testData.files))
+    if err == nil {
+      t.Errorf("expected cycle %s to be detected", testData.chain)
+    } else if !strings.HasSuffix(err.Error(), testData.chain) {
+      t.Errorf("expected cycle %s, got %v", testData.chain, err)
+    }
+  }
+}
+
+func TestWorkers(t *testing.T) {
+  files := map[string][]byte{
+    "base.tmpl": []byte(`{{block "content" .}}{{end}}`),
+  }
+  for i := 0; i < 100; i++ {
+    files[fmt.Sprintf("Page%03d.tmpl", i)] = []byte(fmt.Sprintf(`{{extend "base"}}{{define "content"}}%d{{end}}`, i))
+  }
+  for _, i := range []int{37, 64, 90} {
+    files[fmt.Sprintf("Page%03d.tmpl", i)] = []byte(fmt.Sprintf(`{{extend "base"}}{{define "content"}}{{%d}`, i))
+  }
+
+  sequential := TextCache(Workers(1))
+  expect := sequential.Load(PreloadedFiles(files))
+  if expect == nil {
+    t.Fatal("expected load to fail")
+  }
+
+  for n := 0; n < 20; n++ {
+    err := TextCache(Workers(8)).Load(PreloadedFiles(files))
+    if err == nil || err.Error() != expect.Error() {
+      t.Fatalf("expected error %q, got %v", expect, err)
+    }
+  }
+
+  delete(files, "Page037.tmpl")
+  delete(files, "Page064.tmpl")
+  delete(files, "Page090.tmpl")
+
+  cache := TextCache(Workers(8))
+  if err := cache.Load(PreloadedFiles(files)); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 100; i++ {
+    if i == 37 || i == 64 || i == 90 {
+      continue
+    }
+    str, err := cache.Builder(fmt.Sprintf("page%03d", i)).ExecStr()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if str != fmt.Sprint(i) {
+      t.Errorf("expected %d, got %q", i, str)
+    }
+  }
+}
+
+func benchmarkFiles(pages int) FileCollection {
+  files := map[string][]byte{
+    "base.gohtml": []byte(strings.Join([]string{
+      `<html lang="en">`,
+      `<head><title>{{template "title" .}}</title></head>`,
+      `<body>{{template "nav" .}}{{block "content" .}}{{end}}{{template "footer" .}}</body>`,
+      `</html>`,
+    }, "\n")),
+    "nav.gohtml":    []byte(`{{define "nav"}}<nav>{{range $.Links}}<a href="{{.}}">{{.}}</a>{{end}}</nav>{{end}}`),
+    "footer.gohtml": []byte(`{{define "footer"}}<footer>{{if $.Year}}&copy; {{$.Year}}{{end}}</footer>{{end}}`),
+    "layout.gohtml": []byte(strings.Join([]string{
+      `{{extend "base"}}`,
+      `{{include "nav footer"}}`,
+      `{{define "title"}}{{$.Title}}{{end}}`,
+    }, "\n")),
+  }
+  for i := 0; i < pages; i++ {
+    files[fmt.Sprintf("Page%d.gohtml", i)] = []byte(strings.Join([]string{
+      `{{extend "layout"}}`,
+      fmt.Sprintf(`{{define "content"}}<h1>Page %d</h1><p>{{$.Body}}</p>{{end}}`, i),
+    }, "\n"))
+  }
+  return PreloadedFiles(files)
+}
+
+func benchmarkLoad(b *testing.B, root templateCreator, load func(fc FileCollection, root templateCreator) error) {
+  files := benchmarkFiles(500)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if err := load(files, root); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+// Loads the templates with Cache.Load, which parses shared parent sets once and clones them. A single worker is
+// used so that the comparison with baselineLoad is not affected by reading and parsing concurrently.
+func cacheLoad(fc FileCollection, root templateCreator) error {
+  return newTemplateCache(root, Workers(1)).Load(fc)
+}
+
+// Loads the templates in the same way as createTemplates did before shared parent sets were introduced, parsing
+// every exported template's whole stack from scratch. The code is createTemplates and recurseTemplates as they were,
+// changed only to match the current signatures of loadTemplate and templateCreator.Create.
+func baselineLoad(fc FileCollection, root templateCreator) error {
+  config := newCacheConfig()
+  tcs := make(map[string]templateCreator)
+  data := make(map[string]*tpldata)
+  files, err := fc.Resolve()
+  if err != nil {
+    return err
+  }
+  for _, name := range files.Names {
+    if tplType := defaultExportRule(name); tplType == Exported {
+      data, err := baselineRecurseTemplates(files, data, name, config)
+      if err != nil {
+        return err
+      }
+      templateStack, i := make([]string, 1+len(data[name].extends)+len(data[name].includes)), 0
+      for _, parent := range data[name].extends {
+        templateStack[i] = parent
+        i++
+      }
+      templateStack[i] = name
+      i++
+      for _, included := range data[name].includes {
+        templateStack[i] = included
+        i++
+      }
+      tpl, err := root.Create(templateStack[0], string(data[templateStack[0]].content), config)
+      if err != nil {
+        return err
+      }
+      for j := 1; j < len(templateStack); j++ {
+        _, err := tpl.Create(templateStack[j], string(data[templateStack[j]].content), nil)
+        if err != nil {
+          return err
+        }
+      }
+      tcs[strings.ToLower(name)] = tpl
+    }
+  }
+  return nil
+}
+
+func baselineRecurseTemplates(
+  fc ResolvedFileCollection, data map[string]*tpldata, name string, config *cacheConfig,
+) (map[string]*tpldata, error) {
+  if _, ok := data[name]; ok {
+    return data, nil
+  }
+
+  tplData, err := loadTemplate(fc, name, config)
+  if err != nil {
+    return data, err
+  }
+
+  data[name] = &tplData
+
+  dependencies := make(map[string]bool)
+  var extends, includes []string
+
+  for _, parent := range tplData.extends {
+    data, err = baselineRecurseTemplates(fc, data, parent, config)
+    if err != nil {
+      return data, err
+    }
+
+    for _, dep := range data[parent].extends {
+      if !dependencies[dep] {
+        extends, dependencies[dep] = append(extends, dep), true
+      }
+    }
+
+    if !dependencies[parent] {
+      extends, dependencies[parent] = append(extends, parent), true
+    }
+
+    for _, dep := range data[parent].includes {
+      if !dependencies[dep] {
+        extends, dependencies[dep] = append(extends, dep), true
+      }
+    }
+  }
+
+  for _, included := range tplData.includes {
+    data, err = baselineRecurseTemplates(fc, data, included, config)
+    if err != nil {
+      return data, err
+    }
+
+    for _, dep := range data[included].extends {
+      if !dependencies[dep] {
+        includes, dependencies[dep] = append(includes, dep), true
+      }
+    }
+
+    if !dependencies[included] {
+      includes, dependencies[included] = append(includes, included), true
+    }
+
+    for _, dep := range data[included].includes {
+      if !dependencies[dep] {
+        includes, dependencies[dep] = append(includes, dep), true
+      }
+    }
+  }
+
+  tplData.extends, tplData.includes = extends, includes
+
+  return data, err
+}
+
+func BenchmarkLoadHTML(b *testing.B) {
+  benchmarkLoad(b, htmlTemplateCreator{}, cacheLoad)
+}
+
+func BenchmarkLoadHTMLBaseline(b *testing.B) {
+  benchmarkLoad(b, htmlTemplateCreator{}, baselineLoad)
+}
+
+func BenchmarkLoadText(b *testing.B) {
+  benchmarkLoad(b, textTemplateCreator{}, cacheLoad)
+}
+
+func BenchmarkLoadTextBaseline(b *testing.B) {
+  benchmarkLoad(b, textTemplateCreator{}, baselineLoad)
+}
+
+func benchmarkExec(b *testing.B, reload bool) {
+  files := benchmarkFiles(500)
+  cache := HTMLCache()
+  if err := cache.Load(files); err != nil {
+    b.Fatal(err)
+  }
+
+  done := make(chan struct{})
+  stopped := make(chan struct{})
+  go func() {
+    defer close(stopped)
+    for reload {
+      select {
+      case <-done:
+        return
+      default:
+      }
+      if err := cache.Load(files); err != nil {
+        b.Error(err)
+        return
+      }
+    }
+  }()
+
+  data := DataMap{"Title": "Title", "Body": "Body", "Year": 2021, "Links": []string{"/", "/about"}}
+  b.ReportAllocs()
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    for i := 0; pb.Next(); i++ {
+      if _, err := cache.Builder(fmt.Sprintf("page%d", i%500)).WithAll(data).ExecStr(); err != nil {
+        b.Error(err)
+        return
+      }
+    }
+  })
+  b.StopTimer()
+  close(done)
+  <-stopped
+}
+
+func BenchmarkExec(b *testing.B) {
+  benchmarkExec(b, false)
+}
+
+// Executes templates in parallel while the cache is continuously reloaded. Executing a template never waits for a
+// load to finish, so any difference from BenchmarkExec is due to the reloads competing for CPU time.
+func BenchmarkExecDuringReload(b *testing.B) {
+  benchmarkExec(b, true)
+}
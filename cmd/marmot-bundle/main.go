@@ -0,0 +1,138 @@
+// Command marmot-bundle creates and verifies signed template bundles, which can be loaded with marmot.Bundle.
+//
+// Usage:
+//  marmot-bundle keygen -key bundle.key
+//  marmot-bundle sign -key bundle.key -out templates.tar.gz [-ext gohtml,gotmpl] templates/
+//  marmot-bundle verify -pub bundle.key.pub templates.tar.gz
+//
+// Keys are stored base64-encoded: keygen writes the private key to the given path, and the public key to the same
+// path with ".pub" appended.
+package main
+
+import (
+  "crypto/ed25519"
+  "crypto/rand"
+  "encoding/base64"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
+
+  "github.com/pantonshire/marmot"
+)
+
+func main() {
+  if len(os.Args) < 2 {
+    usage()
+  }
+  var err error
+  switch os.Args[1] {
+  case "keygen":
+    err = keygen(os.Args[2:])
+  case "sign":
+    err = sign(os.Args[2:])
+  case "verify":
+    err = verify(os.Args[2:])
+  default:
+    usage()
+  }
+  if err != nil {
+    fmt.Fprintln(os.Stderr, "marmot-bundle:", err)
+    os.Exit(1)
+  }
+}
+
+func usage() {
+  fmt.Fprintln(os.Stderr, "usage:")
+  fmt.Fprintln(os.Stderr, "  marmot-bundle keygen -key bundle.key")
+  fmt.Fprintln(os.Stderr,
+    "  marmot-bundle sign -key bundle.key -out templates.tar.gz [-ext gohtml,gotmpl] templates/")
+  fmt.Fprintln(os.Stderr, "  marmot-bundle verify -pub bundle.key.pub templates.tar.gz")
+  os.Exit(2)
+}
+
+func keygen(args []string) error {
+  flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+  keyPath := flags.String("key", "", "path to write the private key to")
+  _ = flags.Parse(args)
+  if *keyPath == "" {
+    usage()
+  }
+  public, private, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return err
+  }
+  if err := writeKey(*keyPath, private, 0600); err != nil {
+    return err
+  }
+  return writeKey(*keyPath+".pub", public, 0644)
+}
+
+func sign(args []string) error {
+  flags := flag.NewFlagSet("sign", flag.ExitOnError)
+  keyPath := flags.String("key", "", "path of the private key")
+  out := flags.String("out", "", "path to write the bundle to")
+  extensions := flags.String("ext", "", "comma-separated extensions of the templates to include")
+  _ = flags.Parse(args)
+  if *keyPath == "" || *out == "" || flags.NArg() != 1 {
+    usage()
+  }
+  key, err := readKey(*keyPath, ed25519.PrivateKeySize)
+  if err != nil {
+    return err
+  }
+  dir := marmot.Directory(flags.Arg(0))
+  if *extensions != "" {
+    dir = dir.MatchExtensions(strings.Split(*extensions, ",")...)
+  }
+  file, err := os.Create(*out)
+  if err != nil {
+    return err
+  }
+  if err := marmot.WriteBundle(file, dir, ed25519.PrivateKey(key)); err != nil {
+    file.Close()
+    return err
+  }
+  return file.Close()
+}
+
+func verify(args []string) error {
+  flags := flag.NewFlagSet("verify", flag.ExitOnError)
+  keyPath := flags.String("pub", "", "path of the public key")
+  _ = flags.Parse(args)
+  if *keyPath == "" || flags.NArg() != 1 {
+    usage()
+  }
+  key, err := readKey(*keyPath, ed25519.PublicKeySize)
+  if err != nil {
+    return err
+  }
+  files, err := marmot.Bundle(flags.Arg(0), ed25519.PublicKey(key)).Resolve()
+  if err != nil {
+    return err
+  }
+  for _, name := range files.Names {
+    fmt.Println(name)
+  }
+  return nil
+}
+
+func writeKey(path string, key []byte, perm os.FileMode) error {
+  return ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), perm)
+}
+
+func readKey(path string, size int) ([]byte, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+  if err != nil {
+    return nil, fmt.Errorf("%s: invalid key: %v", path, err)
+  }
+  if len(key) != size {
+    return nil, fmt.Errorf("%s: invalid key: expected %d bytes, got %d", path, size, len(key))
+  }
+  return key, nil
+}
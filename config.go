@@ -0,0 +1,233 @@
+package marmot
+
+import (
+  "fmt"
+  "regexp"
+  "runtime"
+  "text/template"
+)
+
+// A CacheOption configures a Cache. Options are passed to HTMLCache or TextCache when the Cache is created, or to
+// Cache.Reconfigure:
+//  cache := marmot.HTMLCache(
+//    marmot.Funcs(marmot.Std()),
+//    marmot.ExportRule(isPage),
+//    marmot.Delims("[[", "]]"),
+//    marmot.Option("missingkey=error"),
+//  )
+//
+// An ExportRule or a NameRule can be used as an option directly.
+type CacheOption interface {
+  apply(config *cacheConfig)
+}
+
+type optionFunc func(config *cacheConfig)
+
+func (fn optionFunc) apply(config *cacheConfig) {
+  fn(config)
+}
+
+// Adds the functions to those which can be used in the templates. Functions added by earlier options with the same
+// names are replaced.
+func Funcs(funcs FuncMap) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    for key, fn := range funcs {
+      config.funcs[key] = fn
+    }
+  })
+}
+
+// Specifies the delimiters used by the templates, including by extend and include, in place of {{ and }}. An empty
+// delimiter means the default.
+func Delims(left, right string) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.left, config.right = left, right
+  })
+}
+
+// Specifies options for executing the templates, in the same format as text/template's Template.Option, such as
+// "missingkey=error".
+func Option(options ...string) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.options = append(config.options, options...)
+  })
+}
+
+// Specifies whether blocks may be shadowed between included templates. In strict mode, Cache.Load and Cache.Refresh
+// fail with a ShadowedBlockError if a block defined by one included template is redefined by another included
+// template which does not extend it. Redefining blocks from the exported template or its ancestors is always allowed.
+//
+// Cache.Blocks can be used to see which template supplies each block.
+func StrictBlocks(strict bool) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.strict = strict
+  })
+}
+
+// Specifies the maximum number of templates which are read and parsed concurrently by Cache.Load and Cache.Refresh.
+// A value of 1 or less loads the templates one at a time. The templates produced, and the error returned if loading
+// fails, are the same regardless of the number of workers.
+//
+// By default, the number of workers is runtime.GOMAXPROCS(0).
+func Workers(n int) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.workers = n
+  })
+}
+
+// Specifies whether exported templates are compiled lazily. Normally, Cache.Load and the other methods which load
+// templates compile every exported template before returning. With lazy compilation, they only read the templates
+// and resolve their dependencies, and each exported template is compiled the first time it is executed. If several
+// goroutines execute a template which has not been compiled yet at the same time, it is only compiled once.
+//
+// Since templates are not compiled when they are loaded, parse errors are returned when a template is executed
+// rather than when it is loaded. Use Cache.Validate to check every template up front.
+func LazyCompilation(lazy bool) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.lazy = lazy
+  })
+}
+
+// Limits the number of lazily compiled templates kept by the Cache, and their total size in bytes, as estimated from
+// the size of their sources. Once either limit is exceeded, the least recently executed templates are discarded, and
+// are compiled again when they are next executed. A limit of zero means no limit, which is the default.
+//
+// Unlike the other options, the limits apply to the templates already loaded as soon as they are set.
+func CompileLimit(templates int, bytes int64) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.maxTemplates, config.maxBytes = templates, bytes
+  })
+}
+
+// Specifies how many generations the Cache keeps, including the current one, for Cache.Rollback and
+// Builder.WithGeneration. A value of 1 or less keeps only the current generation. By default, the Cache keeps
+// DefaultGenerationHistory generations.
+//
+// Unlike the other options, the number of generations applies to the Cache as a whole rather than to the templates
+// loaded with it, so it is used whenever a generation is created, including by Cache.Refresh.
+func History(n int) CacheOption {
+  return optionFunc(func(config *cacheConfig) {
+    config.history = n
+  })
+}
+
+func (rule ExportRule) apply(config *cacheConfig) {
+  config.export = rule
+}
+
+func (rule NameRule) apply(config *cacheConfig) {
+  config.nameRule = rule
+}
+
+// The configuration of a Cache. A cacheConfig is never modified once it is in use: changing the configuration
+// replaces it with a modified copy. Each templateSet keeps the configuration it was built with, which is also used to
+// compile its templates lazily.
+type cacheConfig struct {
+  funcs        FuncMap
+  export       ExportRule
+  strict       bool
+  workers      int
+  lazy         bool
+  maxTemplates int
+  maxBytes     int64
+  history      int
+  nameRule     NameRule
+  left, right  string
+  options      []string
+  reExtend     *regexp.Regexp
+  reInclude    *regexp.Regexp
+}
+
+func newCacheConfig() *cacheConfig {
+  return &cacheConfig{
+    funcs:     make(FuncMap),
+    workers:   runtime.GOMAXPROCS(0),
+    history:   DefaultGenerationHistory,
+    nameRule:  DefaultNameRule,
+    reExtend:  reExtend,
+    reInclude: reInclude,
+  }
+}
+
+// Returns a copy of the configuration with the options applied, or an error if any of the execution options are not
+// recognised.
+func (config *cacheConfig) with(opts ...CacheOption) (*cacheConfig, error) {
+  next := *config
+  next.funcs = make(FuncMap, len(config.funcs))
+  for key, fn := range config.funcs {
+    next.funcs[key] = fn
+  }
+  next.options = append([]string(nil), config.options...)
+  for _, opt := range opts {
+    opt.apply(&next)
+  }
+  if err := checkOptions(next.options); err != nil {
+    return nil, err
+  }
+  next.reExtend, next.reInclude = reExtend, reInclude
+  if next.left != "" || next.right != "" {
+    next.reExtend, next.reInclude = directiveRegexp(next.leftDelim(), next.rightDelim(), "extend"),
+      directiveRegexp(next.leftDelim(), next.rightDelim(), "include")
+  }
+  return &next, nil
+}
+
+func (config *cacheConfig) leftDelim() string {
+  if config.left == "" {
+    return "{{"
+  }
+  return config.left
+}
+
+func (config *cacheConfig) rightDelim() string {
+  if config.right == "" {
+    return "}}"
+  }
+  return config.right
+}
+
+// Returns a regular expression matching the directive with the given delimiters, along with any newlines after it,
+// in the same way as reExtend and reInclude.
+func directiveRegexp(left, right, directive string) *regexp.Regexp {
+  left, right = regexp.QuoteMeta(left), regexp.QuoteMeta(right)
+  return regexp.MustCompile(
+    `(?s)` + left + `\s*` + directive + `(\s.*?` + right + `|` + right + `)(\s*(\r\n|\r|\n))*`,
+  )
+}
+
+// Returns an error if text/template does not recognise any of the options, rather than letting it panic when the
+// templates are parsed.
+func checkOptions(options []string) (err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      err = fmt.Errorf("invalid template option: %v", r)
+    }
+  }()
+  template.New("").Option(options...)
+  return nil
+}
+
+func (c *templateCache) Reconfigure(opts ...CacheOption) error {
+  c.update.Lock()
+  defer c.update.Unlock()
+  config, err := c.configuration().with(opts...)
+  if err != nil {
+    return err
+  }
+  if prev := c.set(); prev.files.FileCollection != nil {
+    files, err := resolveWith(prev.files.FileCollection, resolution{rule: config.nameRule})
+    if err != nil {
+      return err
+    }
+    set, err := c.buildSet(files, nil, nil, config)
+    if err != nil {
+      return err
+    }
+    set.load = prev.load
+    c.storeConfig(config)
+    c.publish(set)
+    return nil
+  }
+  c.storeConfig(config)
+  return nil
+}
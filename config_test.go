@@ -0,0 +1,101 @@
+package marmot
+
+import (
+  "errors"
+  "strings"
+  "sync"
+  "testing"
+)
+
+func TestOptions(t *testing.T) {
+  contents := map[string][]byte{
+    "base.tmpl": []byte(`<[[template "content" .]]>`),
+    "Home.tmpl": []byte("[[extend\n\"base\"]]\n[[define \"content\"]][[shout $.Name]][[end]]"),
+    "Bad.tmpl":  []byte("[[extend\n\"base\"]]\n[[define \"content\"]][[end]\n"),
+  }
+  files := PreloadedFiles(contents)
+  exportAll := ExportRule(func(name string) TemplateType {
+    return Exported
+  })
+  cache := TextCache(
+    Funcs(FuncMap{"shout": strings.ToUpper}),
+    Delims("[[", "]]"),
+    Option("missingkey=error"),
+    exportAll,
+  )
+
+  var parseErr *ParseError
+  if err := cache.Load(files); !errors.As(err, &parseErr) || parseErr.Name != "Bad" || parseErr.Line != 3 {
+    t.Errorf("expected a parse error on line 3 of Bad, got %v", err)
+  }
+  delete(contents, "Bad.tmpl")
+  if err := cache.Load(files); err != nil {
+    t.Fatal(err)
+  }
+  if str, err := cache.Builder("home").With("Name", "marmot").ExecStr(); err != nil || str != "<MARMOT>" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+
+  generation := cache.Generation()
+  sameKey := NameRule{Key: func(name string) string {
+    return "page"
+  }}
+  var keyErr *DuplicateKeyError
+  if err := cache.Reconfigure(Funcs(FuncMap{"shout": strings.ToLower}), sameKey); !errors.As(err, &keyErr) {
+    t.Errorf("expected reconfiguring to fail when the templates do not load, got %v", err)
+  }
+  if err := cache.Reconfigure(Funcs(FuncMap{"shout": strings.ToLower})); err != nil {
+    t.Fatal(err)
+  }
+  if cache.Generation() != generation+1 {
+    t.Errorf("expected reconfiguring to create generation %d, got %d", generation+1, cache.Generation())
+  }
+  if str, err := cache.Builder("home").With("Name", "MARMOT").ExecStr(); err != nil || str != "<marmot>" {
+    t.Errorf("unexpected output after reconfiguring %q %v", str, err)
+  }
+  str, err := cache.Builder("home").WithGeneration(generation).With("Name", "marmot").ExecStr()
+  if err != nil || str != "<MARMOT>" {
+    t.Errorf("expected the previous generation to keep its configuration, got %q %v", str, err)
+  }
+
+  missing := TextCache(Option("missingkey=error"), exportAll)
+  if err := missing.Load(PreloadedFiles(map[string][]byte{"page.tmpl": []byte(`{{$.Missing}}`)})); err != nil {
+    t.Fatal(err)
+  }
+  var execErr *ExecError
+  if _, err := missing.Builder("page").ExecStr(); !errors.As(err, &execErr) {
+    t.Errorf("expected a missing key to fail, got %v", err)
+  }
+
+  if err := cache.Reconfigure(Option("missingkey=nonsense")); err == nil {
+    t.Error("expected an unrecognised option to fail")
+  }
+  func() {
+    defer func() {
+      if recover() == nil {
+        t.Error("expected an unrecognised option to panic")
+      }
+    }()
+    HTMLCache(Option("nonsense"))
+  }()
+}
+
+func TestConfigureDuringLoad(t *testing.T) {
+  files := benchmarkFiles(50)
+  cache := TextCache()
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(2)
+    go func() {
+      defer wg.Done()
+      if err := cache.Load(files); err != nil {
+        t.Error(err)
+      }
+    }()
+    go func() {
+      defer wg.Done()
+      cache.WithFuncs(Std()).WithExportRule(defaultExportRule).WithHistory(3).WithWorkers(2)
+    }()
+  }
+  wg.Wait()
+}
@@ -13,14 +13,15 @@ import (
 //
 // To create a Builder, use Cache.Builder.
 type Builder struct {
-  cache Cache
-  key   string
-  data  DataMap
+  cache      Cache
+  key        string
+  generation int
+  data       DataMap
 }
 
 // Looks up the template in the Cache, executes the template and writes the output to w.
 func (b *Builder) Exec(w io.Writer) error {
-  return b.cache.exec(w, b.key, b.data)
+  return b.cache.exec(w, b.key, b.generation, b.data)
 }
 
 // Looks up the template in the Cache, executes the template and writes the output to a string.
@@ -50,3 +51,17 @@ func (b *Builder) WithAll(data DataMap) *Builder {
   }
   return b
 }
+
+// Pins the builder to the generation with the given number, so that it executes the template as it was in that
+// generation even if the Cache has been loaded since. Builders for several templates can be pinned to the same
+// generation, as returned by Cache.Generation, so that they render consistently with each other:
+//  generation := cache.Generation()
+//  subject, err := cache.Builder("email/subject").WithGeneration(generation).WithAll(data).ExecStr()
+//  body, err := cache.Builder("email/body").WithGeneration(generation).WithAll(data).ExecStr()
+//
+// Executing the builder returns a GenerationNotFoundError if the generation is no longer kept by the Cache. A
+// generation of 0 means the current generation, which is the default.
+func (b *Builder) WithGeneration(generation int) *Builder {
+  b.generation = generation
+  return b
+}
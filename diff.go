@@ -0,0 +1,198 @@
+package marmot
+
+import (
+  "fmt"
+  "strings"
+)
+
+// The number of unchanged lines shown around each change in a unified diff.
+const diffContext = 3
+
+// The most lines a unified diff will remove and add. The time and memory taken to find the changes grow with the
+// square of their number, so outputs which differ by more are reported without a diff.
+const maxDiffEdits = 1000
+
+type diffLine struct {
+  op   byte
+  text string
+}
+
+// Returns a unified diff of the lines of a and b, labelled with the given names, or an empty string if they are
+// equal. If they differ by more than maxDiffEdits lines, only the names are given, followed by a note that the diff
+// is too large.
+func unifiedDiff(aName, bName, a, b string) string {
+  if a == b {
+    return ""
+  }
+  lines, ok := diffLines(splitLines(a), splitLines(b))
+  if !ok {
+    return fmt.Sprintf("--- %s\n+++ %s\noutputs differ (diff too large)\n", aName, bName)
+  }
+
+  var changes []int
+  for i, line := range lines {
+    if line.op != ' ' {
+      changes = append(changes, i)
+    }
+  }
+
+  var sb strings.Builder
+  fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+  for i := 0; i < len(changes); {
+    // Changes which are close enough for their context to overlap are shown in the same hunk.
+    j := i
+    for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*diffContext {
+      j++
+    }
+    start, end := changes[i]-diffContext, changes[j]+diffContext+1
+    if start < 0 {
+      start = 0
+    }
+    if end > len(lines) {
+      end = len(lines)
+    }
+    writeHunk(&sb, lines, start, end)
+    i = j + 1
+  }
+  return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, lines []diffLine, start, end int) {
+  aStart, bStart := 1, 1
+  for _, line := range lines[:start] {
+    if line.op != '+' {
+      aStart++
+    }
+    if line.op != '-' {
+      bStart++
+    }
+  }
+  var aCount, bCount int
+  for _, line := range lines[start:end] {
+    if line.op != '+' {
+      aCount++
+    }
+    if line.op != '-' {
+      bCount++
+    }
+  }
+  // An empty range is given as the line before it.
+  if aCount == 0 {
+    aStart--
+  }
+  if bCount == 0 {
+    bStart--
+  }
+  fmt.Fprintf(sb, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+  for _, line := range lines[start:end] {
+    sb.WriteByte(line.op)
+    sb.WriteString(line.text)
+    if !strings.HasSuffix(line.text, "\n") {
+      sb.WriteString("\n\\ No newline at end of file\n")
+    }
+  }
+}
+
+// Splits s into lines, keeping the newline at the end of each line.
+func splitLines(s string) []string {
+  lines := strings.SplitAfter(s, "\n")
+  if lines[len(lines)-1] == "" {
+    lines = lines[:len(lines)-1]
+  }
+  return lines
+}
+
+// Returns the lines of a and b, marked as unchanged, removed from a or added in b, using the shortest sequence of
+// removals and additions found by Myers' O(ND) algorithm. Lines common to the start and end of both are skipped
+// before finding the edits. If more than maxDiffEdits lines would have to be removed and added, it gives up and
+// returns false.
+func diffLines(a, b []string) ([]diffLine, bool) {
+  prefix := 0
+  for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+    prefix++
+  }
+  suffix := 0
+  for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+    suffix++
+  }
+  am, bm := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+  n, m := len(am), len(bm)
+
+  // v[offset+k] is the furthest position in am reached on diagonal k, where the position in bm is that minus k.
+  // trace[d] keeps the positions on diagonals -d to d after d edits, for working back along the path afterwards.
+  maxEdits := n + m
+  if maxEdits > maxDiffEdits {
+    maxEdits = maxDiffEdits
+  }
+  offset := maxEdits + 1
+  v := make([]int, 2*offset+1)
+  var trace [][]int
+  for d := 0; ; d++ {
+    if d > maxEdits {
+      return nil, false
+    }
+    done := false
+    for k := -d; k <= d && !done; k += 2 {
+      var x int
+      if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+        x = v[offset+k+1]
+      } else {
+        x = v[offset+k-1] + 1
+      }
+      y := x - k
+      for x < n && y < m && am[x] == bm[y] {
+        x++
+        y++
+      }
+      v[offset+k] = x
+      done = x >= n && y >= m
+    }
+    trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+    if done {
+      break
+    }
+  }
+
+  // Work back from the end of both to find the edit made at each step, and the unchanged lines after it.
+  var edits []diffLine
+  x, y := n, m
+  for d := len(trace) - 1; d > 0; d-- {
+    prev := trace[d-1]
+    k := x - y
+    prevK := k - 1
+    if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+      prevK = k + 1
+    }
+    prevX := prev[prevK+d-1]
+    prevY := prevX - prevK
+    for x > prevX && y > prevY {
+      edits = append(edits, diffLine{' ', am[x-1]})
+      x--
+      y--
+    }
+    if x == prevX {
+      edits = append(edits, diffLine{'+', bm[y-1]})
+      y--
+    } else {
+      edits = append(edits, diffLine{'-', am[x-1]})
+      x--
+    }
+  }
+  for x > 0 && y > 0 {
+    edits = append(edits, diffLine{' ', am[x-1]})
+    x--
+    y--
+  }
+
+  lines := make([]diffLine, 0, prefix+len(edits)+suffix)
+  for _, text := range a[:prefix] {
+    lines = append(lines, diffLine{' ', text})
+  }
+  for i := len(edits) - 1; i >= 0; i-- {
+    lines = append(lines, edits[i])
+  }
+  for _, text := range a[len(a)-suffix:] {
+    lines = append(lines, diffLine{' ', text})
+  }
+  return lines, true
+}
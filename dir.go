@@ -0,0 +1,386 @@
+package marmot
+
+import (
+  "errors"
+  "fmt"
+  "io/fs"
+  "os"
+  "path"
+  "path/filepath"
+  "regexp"
+  "strings"
+)
+
+// A Dir is a FileCollection which walks a directory tree, and whose files can be filtered by their paths.
+//
+// If a file named .marmotignore exists at the root of the directory, the files and directories it matches are
+// skipped. It uses the same syntax as a .gitignore file.
+type Dir interface {
+  FileCollection
+  PartialMatch(pattern *regexp.Regexp) Dir
+  FullMatch(pattern *regexp.Regexp) Dir
+  MatchExtensions(extensions ...string) Dir
+  Exclude(pattern *regexp.Regexp) Dir
+  Glob(patterns ...string) Dir
+  FollowSymlinks() Dir
+}
+
+// Directory, FS and Archive are all implemented by walking one or more fs.FS roots.
+type directory struct {
+  roots    []fsRoot
+  symlinks bool
+  patterns []*regexp.Regexp
+  excludes []*regexp.Regexp
+  globs    globRules
+  err      error
+}
+
+// A single tree walked by a directory. For a Directory, the fs.FS is an os.DirFS and the paths given to Read are OS
+// paths rather than paths within the fs.FS. For an Archive, the fs.FS is opened every time the collection is
+// resolved, and the paths given to Read are prefixed with the archive's path.
+type fsRoot struct {
+  fsys   fs.FS
+  open   func() (fs.FS, error)
+  root   string
+  path   string
+  prefix string
+}
+
+// Creates a new FileCollection which walks the specified directory in order to generate a list of file paths.
+func Directory(path string) Dir {
+  return Directories(path)
+}
+
+// Creates a new FileCollection which walks each of the specified directories in turn, naming templates by their
+// path relative to the directory they were found in. A template name found in more than one of the directories is
+// reported as a DuplicateTemplateError.
+func Directories(paths ...string) Dir {
+  d := directory{roots: make([]fsRoot, len(paths))}
+  for i, path := range paths {
+    path = filepath.Clean(path)
+    d.roots[i] = fsRoot{fsys: os.DirFS(path), root: ".", path: path}
+  }
+  return d
+}
+
+// Creates a new FileCollection which walks the directory root of the given fs.FS, such as an embed.FS, in order to
+// generate a list of file paths. The root should be in the slash-separated format used by io/fs; use "." to walk
+// the whole fs.FS.
+//
+// Templates are named by their path relative to the root, in the same way as for Directory:
+//  //go:embed templates
+//  var templates embed.FS
+//
+//  _ = cache.Load(marmot.FS(templates, "templates"))
+//  builder := cache.Builder("customer/checkout")
+func FS(fsys fs.FS, root string) Dir {
+  return directory{roots: []fsRoot{{fsys: fsys, root: path.Clean(root)}}}
+}
+
+// Files in the directory will be matched if the specified pattern appears anywhere in the file's path.
+// The paths checked against this pattern will be cleaned paths in slash format relative to the directory.
+func (d directory) PartialMatch(pattern *regexp.Regexp) Dir {
+  d.patterns = append(d.patterns, pattern)
+  return d
+}
+
+// Files in the directory will be matched if the entire path conforms to the specified pattern.
+// The paths checked against this pattern will be cleaned paths in slash format relative to the directory.
+func (d directory) FullMatch(pattern *regexp.Regexp) Dir {
+  d.patterns = append(d.patterns, regexp.MustCompile(fmt.Sprintf("^%s$", pattern.String())))
+  return d
+}
+
+// Files in the directory will be matched if they have any of the given extensions.
+// The extensions should exclude the leading dot.
+func (d directory) MatchExtensions(extensions ...string) Dir {
+  if len(extensions) == 0 {
+    return d
+  }
+  escapedExtensions := make([]string, len(extensions))
+  for i, extension := range extensions {
+    escapedExtensions[i] = regexp.QuoteMeta(extension)
+  }
+  var pattern string
+  if len(escapedExtensions) > 1 {
+    pattern = fmt.Sprintf(`.*\.(%s)`, strings.Join(escapedExtensions, `|`))
+  } else {
+    pattern = fmt.Sprintf(`.*\.%s`, escapedExtensions[0])
+  }
+  d.patterns = append(d.patterns, regexp.MustCompile(pattern))
+  return d
+}
+
+// Files in the directory will be skipped if the specified pattern appears anywhere in the file's path.
+// The paths checked against this pattern will be cleaned paths in slash format relative to the directory.
+func (d directory) Exclude(pattern *regexp.Regexp) Dir {
+  d.excludes = append(d.excludes, pattern)
+  return d
+}
+
+// Files in the directory will be matched according to the given gitignore-style glob patterns, such as
+// "**/*.gohtml" or "!legacy/**". A file is matched if the last pattern which matches its path is not negated
+// with a leading "!". If every pattern is negated, files which no pattern matches are included, so that
+// Glob("!legacy/**") only skips the files in legacy. A pattern with a trailing "/", such as "partials/", matches
+// every file inside the directories it matches. If Glob is called more than once, the patterns are appended to those
+// given previously.
+//
+// The paths checked against these patterns will be cleaned paths in slash format relative to the directory. Any
+// invalid pattern is reported when the Dir is resolved.
+func (d directory) Glob(patterns ...string) Dir {
+  rules, err := compileGlobs(patterns)
+  if err != nil {
+    if d.err == nil {
+      d.err = err
+    }
+    return d
+  }
+  d.globs = append(d.globs, rules...)
+  return d
+}
+
+// Symbolic links to directories will be followed when walking the directory, rather than skipped. Templates found
+// through a link are named by their path through the link, as if the linked directory had been copied there. A
+// link to one of its own ancestors, or to a directory which is already being walked through another link, is skipped
+// rather than followed forever.
+//
+// Symbolic links to files are always read, whether or not FollowSymlinks is used.
+func (d directory) FollowSymlinks() Dir {
+  d.symlinks = true
+  return d
+}
+
+// Reads the file at a path returned by Resolve directly, without walking the directory again. Paths outside every
+// root are reported as not existing.
+func (d directory) Read(path string) ([]byte, error) {
+  for _, root := range d.roots {
+    fsPath, ok := root.fsPath(path)
+    if !ok {
+      continue
+    }
+    root, err := root.opened()
+    if err != nil {
+      return nil, err
+    }
+    return fs.ReadFile(root.fsys, fsPath)
+  }
+  return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+}
+
+func (d directory) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(d, defaultResolution)
+}
+
+func (d directory) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  if d.err != nil {
+    return ResolvedFileCollection{}, nil, d.err
+  }
+  resolved := resolvedDirectory{directory: d, files: make(map[string]dirFile)}
+  r := newResolver()
+  for _, root := range d.roots {
+    root, err := root.opened()
+    if err != nil {
+      return ResolvedFileCollection{}, nil, err
+    }
+    ignore, err := root.ignoreRules()
+    if err != nil {
+      return ResolvedFileCollection{}, nil, err
+    }
+    w := walker{directory: d, root: root, ignore: ignore}
+    err = w.walk(root.root, []string{root.realPath(root.root)}, func(fsPath, rel string) {
+      fullPath := root.fullPath(fsPath)
+      realPath := fullPath
+      if d.symlinks {
+        realPath = root.realPath(fsPath)
+      }
+      if r.add(res.rule.name(rel), fullPath, realPath) {
+        resolved.files[fullPath] = dirFile{root: root, fsPath: fsPath}
+      }
+    })
+    if err != nil {
+      return ResolvedFileCollection{}, nil, err
+    }
+  }
+  return r.resolved(resolved), r.duplicates, nil
+}
+
+func (d directory) match(slashPath string) bool {
+  for _, pattern := range d.patterns {
+    if !pattern.MatchString(slashPath) {
+      return false
+    }
+  }
+  for _, pattern := range d.excludes {
+    if pattern.MatchString(slashPath) {
+      return false
+    }
+  }
+  if len(d.globs) > 0 {
+    if matched, negated := d.globs.matchFile(slashPath); negated || (!matched && d.globs.includes()) {
+      return false
+    }
+  }
+  return true
+}
+
+// A walker walks a single root of a directory.
+type walker struct {
+  directory
+  root   fsRoot
+  ignore globRules
+}
+
+// Walks the directory at fsPath in lexical order, calling found for each matching file with its path in the fs.FS
+// and its path relative to the root. When following symlinks, each linked directory is walked in the same way,
+// unless it is on the current walk path: the directory containing the link, one of its ancestors, or one of the
+// directories walked through to reach it. Those are given by walking, the real paths of the root and of each link
+// followed so far and the directory containing it.
+func (w walker) walk(fsPath string, walking []string, found func(fsPath, rel string)) error {
+  return fs.WalkDir(w.root.fsys, fsPath, func(childPath string, entry fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    } else if childPath == fsPath {
+      return nil
+    }
+    rel := childPath
+    if w.root.root != "." {
+      rel = strings.TrimPrefix(childPath, w.root.root+"/")
+    }
+    isDir, isLink := entry.IsDir(), false
+    if entry.Type()&fs.ModeSymlink != 0 {
+      // A broken link is treated as a file, so that it is reported when it is read.
+      if info, err := fs.Stat(w.root.fsys, childPath); err == nil && info.IsDir() {
+        if !w.symlinks {
+          return nil
+        }
+        isDir, isLink = true, true
+      }
+    }
+    if w.ignore.ignores(rel, isDir) {
+      if isDir && !isLink {
+        return fs.SkipDir
+      }
+      return nil
+    }
+    if isLink {
+      target, parent := w.root.realPath(childPath), w.root.realPath(path.Dir(childPath))
+      if w.contains(target, parent) {
+        return nil
+      }
+      for _, walked := range walking {
+        if w.contains(target, walked) {
+          return nil
+        }
+      }
+      return w.walk(childPath, append(walking[:len(walking):len(walking)], parent, target), found)
+    } else if !isDir && rel != IgnoreFileName && w.match(rel) {
+      found(childPath, rel)
+    }
+    return nil
+  })
+}
+
+// Returns whether the real path dir is the same as, or an ancestor of, the real path of the directory walked. If it
+// is, following a link to dir would walk the same directories forever.
+func (w walker) contains(dir, walked string) bool {
+  separator := "/"
+  if w.root.path != "" {
+    separator = string(filepath.Separator)
+  }
+  return dir == walked || strings.HasPrefix(walked, strings.TrimSuffix(dir, separator)+separator)
+}
+
+// Returns a copy of the root whose fs.FS has been opened, if it is opened lazily.
+func (r fsRoot) opened() (fsRoot, error) {
+  if r.open == nil {
+    return r, nil
+  }
+  fsys, err := r.open()
+  if err != nil {
+    return r, err
+  }
+  r.fsys, r.open = fsys, nil
+  return r, nil
+}
+
+// Converts a path within the fs.FS to the path given to Read, which is an OS path for a Directory.
+func (r fsRoot) fullPath(fsPath string) string {
+  if r.path == "" {
+    return r.prefix + fsPath
+  }
+  return filepath.Join(r.path, filepath.FromSlash(fsPath))
+}
+
+// Converts a path given to Read back to a path within the fs.FS, reporting whether it is inside the root.
+func (r fsRoot) fsPath(fullPath string) (string, bool) {
+  fsPath := strings.TrimPrefix(fullPath, r.prefix)
+  if r.path != "" {
+    rel, err := filepath.Rel(r.path, fullPath)
+    if err != nil {
+      return "", false
+    }
+    fsPath = path.Join(r.root, filepath.ToSlash(rel))
+  } else if !strings.HasPrefix(fullPath, r.prefix) {
+    return "", false
+  }
+  if !fs.ValidPath(fsPath) || (r.root != "." && !strings.HasPrefix(fsPath, r.root+"/")) {
+    return "", false
+  }
+  return fsPath, true
+}
+
+// Returns the full path with any symbolic links resolved. Only a Directory can contain symbolic links, so for any
+// other fs.FS this is the same as the full path.
+func (r fsRoot) realPath(fsPath string) string {
+  fullPath := r.fullPath(fsPath)
+  if r.path == "" {
+    return fullPath
+  }
+  if realPath, err := filepath.EvalSymlinks(fullPath); err == nil {
+    return realPath
+  }
+  return fullPath
+}
+
+// Reads the rules from the ignore file at the root, if there is one.
+func (r fsRoot) ignoreRules() (globRules, error) {
+  data, err := fs.ReadFile(r.fsys, path.Join(r.root, IgnoreFileName))
+  if errors.Is(err, fs.ErrNotExist) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  rules, err := parseIgnoreFile(data)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", r.fullPath(path.Join(r.root, IgnoreFileName)), err)
+  }
+  return rules, nil
+}
+
+// The FileCollection of a resolved directory, which remembers which root each file was found in. Resolving it
+// again walks the directory again.
+type resolvedDirectory struct {
+  directory
+  files map[string]dirFile
+}
+
+type dirFile struct {
+  root   fsRoot
+  fsPath string
+}
+
+func (d resolvedDirectory) Read(path string) ([]byte, error) {
+  file, ok := d.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+  }
+  return fs.ReadFile(file.root.fsys, file.fsPath)
+}
+
+func (d resolvedDirectory) stat(path string) (fs.FileInfo, error) {
+  file, ok := d.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+  }
+  return fs.Stat(file.root.fsys, file.fsPath)
+}
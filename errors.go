@@ -0,0 +1,306 @@
+package marmot
+
+import (
+  "errors"
+  "fmt"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// Errors which can be compared with the errors returned by marmot using errors.Is, to check what kind of error
+// occurred without needing its details. Each matches the error type of the same name, so for example:
+//  if errors.Is(err, marmot.ErrTemplateNotFound) {
+//    http.NotFound(w, r)
+//  }
+var (
+  ErrTemplateNotFound   = errors.New("template not found")
+  ErrGenerationNotFound = errors.New("generation not found")
+  ErrDuplicateTemplate  = errors.New("duplicate template name")
+  ErrDuplicateKey       = errors.New("duplicate template key")
+  ErrMissingDependency  = errors.New("missing template dependency")
+  ErrCycle              = errors.New("cyclic template dependency")
+  ErrShadowedBlock      = errors.New("shadowed block")
+  ErrParse              = errors.New("failed to parse template")
+  ErrExec               = errors.New("failed to execute template")
+  ErrBundle             = errors.New("bundle failed verification")
+)
+
+// Returned when attempting to execute a template which has not been loaded, or which is not exported.
+type TemplateNotFoundError struct {
+  // The key which was used to look up the template.
+  Key string
+}
+
+func (e *TemplateNotFoundError) Error() string {
+  return fmt.Sprintf("template %s not found", e.Key)
+}
+
+func (e *TemplateNotFoundError) Is(target error) bool {
+  return target == ErrTemplateNotFound
+}
+
+// Returned when a generation of templates is no longer kept by a Cache, or was never loaded.
+type GenerationNotFoundError struct {
+  // The number of the generation.
+  Generation int
+}
+
+func (e *GenerationNotFoundError) Error() string {
+  return fmt.Sprintf("generation %d not found", e.Generation)
+}
+
+func (e *GenerationNotFoundError) Is(target error) bool {
+  return target == ErrGenerationNotFound
+}
+
+// Returned when two files in a FileCollection would produce templates with the same name.
+type DuplicateTemplateError struct {
+  // The name shared by both templates.
+  Name string
+  // The path of the file which was found first.
+  Path string
+  // The path of the file which was found second.
+  DuplicatePath string
+}
+
+func (e *DuplicateTemplateError) Error() string {
+  return fmt.Sprintf("duplicate template name %s used by both %s and %s", e.Name, e.Path, e.DuplicatePath)
+}
+
+func (e *DuplicateTemplateError) Is(target error) bool {
+  return target == ErrDuplicateTemplate
+}
+
+// Returned when two exported templates have the same key according to the Cache's NameRule, so that Cache.Builder
+// could not tell them apart.
+type DuplicateKeyError struct {
+  // The key shared by both templates.
+  Key string
+  // The name and path of the template which was found first.
+  Name string
+  Path string
+  // The name and path of the template which was found second.
+  DuplicateName string
+  DuplicatePath string
+}
+
+func (e *DuplicateKeyError) Error() string {
+  return fmt.Sprintf("duplicate template key %s used by both %s (%s) and %s (%s)",
+    e.Key, e.Name, e.Path, e.DuplicateName, e.DuplicatePath)
+}
+
+func (e *DuplicateKeyError) Is(target error) bool {
+  return target == ErrDuplicateKey
+}
+
+// Returned when a template extends or includes a template which does not exist in the FileCollection.
+type MissingDependencyError struct {
+  // The name of the template which could not be found.
+  Name string
+  // The name of the template which extends or includes the missing template. It is empty if the missing template
+  // was not referenced by another template.
+  ReferencedBy string
+  // The path of the file of the template which extends or includes the missing template.
+  Path string
+}
+
+func (e *MissingDependencyError) Error() string {
+  if e.ReferencedBy == "" {
+    return fmt.Sprintf("could not load unknown template %s", e.Name)
+  }
+  return fmt.Sprintf("could not load unknown template %s referenced by %s (%s)", e.Name, e.ReferencedBy, e.Path)
+}
+
+func (e *MissingDependencyError) Is(target error) bool {
+  return target == ErrMissingDependency
+}
+
+// Returned when the extends and includes of a template form a cycle.
+type CycleError struct {
+  // The names of the templates in the cycle, starting and ending with the same template.
+  Chain []string
+  // The paths of the files of the templates in Chain.
+  Paths []string
+}
+
+func (e *CycleError) Error() string {
+  links := make([]string, len(e.Chain))
+  for i, name := range e.Chain {
+    links[i] = fmt.Sprintf("%s (%s)", name, e.Paths[i])
+  }
+  return fmt.Sprintf("cyclic dependency between templates: %s", strings.Join(links, " -> "))
+}
+
+func (e *CycleError) Is(target error) bool {
+  return target == ErrCycle
+}
+
+// Returned by Cache.Load in strict mode when a block defined by one included template is redefined by another.
+type ShadowedBlockError struct {
+  // The name of the exported template being built.
+  Template string
+  // The name of the block which was redefined.
+  Block string
+  // The name and path of the template whose definition replaced the other.
+  Name string
+  Path string
+  // The name and path of the template whose definition was replaced.
+  ShadowedName string
+  ShadowedPath string
+}
+
+func (e *ShadowedBlockError) Error() string {
+  return fmt.Sprintf(
+    "block %s defined by %s (%s) shadows its definition in %s (%s), both of which are included by %s",
+    e.Block, e.Name, e.Path, e.ShadowedName, e.ShadowedPath, e.Template,
+  )
+}
+
+func (e *ShadowedBlockError) Is(target error) bool {
+  return target == ErrShadowedBlock
+}
+
+// Returned when a template fails to parse. The underlying error from text/template or html/template can be
+// retrieved with errors.Unwrap.
+type ParseError struct {
+  // The name of the template which failed to parse.
+  Name string
+  // The path of the file of the template which failed to parse.
+  Path string
+  // The line of the file at which the error occurred, or 0 if it is not known.
+  Line int
+  // The name of the exported template which was being built when the error occurred. This differs from Name when
+  // the template which failed to parse was extended or included.
+  Template string
+  // The error message from the template parser, without the template name and line number.
+  Description string
+  Err         error
+}
+
+func (e *ParseError) Error() string {
+  var usedBy string
+  if e.Template != "" && e.Template != e.Name {
+    usedBy = " used by " + e.Template
+  }
+  return fmt.Sprintf("%s: failed to parse template %s%s: %s",
+    location(e.Path, e.Line), e.Name, usedBy, e.description())
+}
+
+func (e *ParseError) Unwrap() error {
+  return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+  return target == ErrParse
+}
+
+func (e *ParseError) description() string {
+  if e.Description != "" {
+    return e.Description
+  }
+  return e.Err.Error()
+}
+
+// Returned when executing a template fails. The underlying error from text/template or html/template can be
+// retrieved with errors.Unwrap.
+//
+// Name, Path, Line and Description are parsed from the message of the underlying error, since the template packages
+// do not report them in any other way. The parsing is best-effort: if the message is not in the format the template
+// packages currently use, they are left empty and only Key and Err are set.
+type ExecError struct {
+  // The key of the template which was being executed.
+  Key string
+  // The name of the template in which the error occurred, which may be one of the templates extended or included
+  // by the template being executed. It is empty if the error did not come from a template, for example if writing
+  // the output failed.
+  Name string
+  // The path of the file of the template in which the error occurred.
+  Path string
+  // The line of the file at which the error occurred, or 0 if it is not known.
+  Line int
+  // The error message from the template package, without the template name and line number.
+  Description string
+  Err         error
+}
+
+func (e *ExecError) Error() string {
+  if e.Name == "" {
+    return fmt.Sprintf("failed to execute template %s: %v", e.Key, e.Err)
+  }
+  path := e.Path
+  if path == "" {
+    path = e.Name
+  }
+  return fmt.Sprintf("%s: failed to execute template %s: %s", location(path, e.Line), e.Key, e.Description)
+}
+
+func (e *ExecError) Unwrap() error {
+  return e.Err
+}
+
+func (e *ExecError) Is(target error) bool {
+  return target == ErrExec
+}
+
+// A list of errors, returned by Cache.Validate. Each error in the list can be found with errors.Is and errors.As.
+type ErrorList []error
+
+func (e ErrorList) Error() string {
+  messages := make([]string, len(e))
+  for i, err := range e {
+    messages[i] = err.Error()
+  }
+  return fmt.Sprintf("%d errors:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+func (e ErrorList) Unwrap() []error {
+  return e
+}
+
+// Reports whether any error in the list matches the target, so that errors.Is finds errors in the list.
+func (e ErrorList) Is(target error) bool {
+  for _, err := range e {
+    if errors.Is(err, target) {
+      return true
+    }
+  }
+  return false
+}
+
+// Finds the first error in the list which matches the target, so that errors.As finds errors in the list.
+func (e ErrorList) As(target interface{}) bool {
+  for _, err := range e {
+    if errors.As(err, target) {
+      return true
+    }
+  }
+  return false
+}
+
+var reTemplateError = regexp.MustCompile(`(?s)^(?:html/)?template: ?(.+?):(\d+):(?:\d+:)? (.*)$`)
+
+// Splits an error message from text/template or html/template, such as "template: name:3: unexpected EOF", into
+// the name of the template, the line number and the rest of the message.
+func splitTemplateError(err error) (name string, line int, description string, ok bool) {
+  match := reTemplateError.FindStringSubmatch(err.Error())
+  if match == nil {
+    return "", 0, "", false
+  }
+  line, convErr := strconv.Atoi(match[2])
+  if convErr != nil {
+    return "", 0, "", false
+  }
+  return match[1], line, match[3], true
+}
+
+func location(path string, line int) string {
+  if line > 0 {
+    return fmt.Sprintf("%s:%d", path, line)
+  }
+  return path
+}
+
+func errDuplicateTemplate(name, dup1, dup2 string) error {
+  return &DuplicateTemplateError{Name: name, Path: dup1, DuplicatePath: dup2}
+}
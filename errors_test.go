@@ -0,0 +1,207 @@
+package marmot
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestErrors(t *testing.T) {
+  loadErr := func(files map[string][]byte) error {
+    return TextCache().Load(PreloadedFiles(files))
+  }
+
+  var duplicate *DuplicateTemplateError
+  err := loadErr(map[string][]byte{"a.tmpl": nil, "a.txt": nil})
+  if !errors.As(err, &duplicate) || !errors.Is(err, ErrDuplicateTemplate) || duplicate.Name != "a" ||
+    duplicate.Path != "a.tmpl" || duplicate.DuplicatePath != "a.txt" {
+    t.Errorf("expected DuplicateTemplateError, got %v", err)
+  }
+
+  var missing *MissingDependencyError
+  err = loadErr(map[string][]byte{"Page.tmpl": []byte(`{{extend "base"}}`)})
+  if !errors.As(err, &missing) || !errors.Is(err, ErrMissingDependency) || missing.Name != "base" ||
+    missing.ReferencedBy != "Page" || missing.Path != "Page.tmpl" {
+    t.Errorf("expected MissingDependencyError, got %v", err)
+  }
+
+  var cycle *CycleError
+  err = loadErr(map[string][]byte{"Page.tmpl": []byte(`{{extend "Page"}}`)})
+  if !errors.As(err, &cycle) || !errors.Is(err, ErrCycle) || len(cycle.Chain) != 2 || cycle.Paths[0] != "Page.tmpl" {
+    t.Errorf("expected CycleError, got %v", err)
+  }
+
+  var parse *ParseError
+  err = loadErr(map[string][]byte{
+    "base.tmpl": []byte(`{{if}}`),
+    "Page.tmpl": []byte(`{{extend "base"}}`),
+  })
+  if !errors.As(err, &parse) || !errors.Is(err, ErrParse) || parse.Name != "base" || parse.Path != "base.tmpl" ||
+    parse.Template != "Page" || errors.Unwrap(err) == nil {
+    t.Errorf("expected ParseError, got %v", err)
+  }
+
+  var notFound *TemplateNotFoundError
+  cache := TextCache()
+  _, err = cache.Builder("missing").ExecStr()
+  if !errors.As(err, &notFound) || !errors.Is(err, ErrTemplateNotFound) || notFound.Key != "missing" {
+    t.Errorf("expected TemplateNotFoundError, got %v", err)
+  }
+
+  // Each error only matches its own sentinel.
+  sentinels := []error{
+    ErrTemplateNotFound, ErrGenerationNotFound, ErrDuplicateTemplate, ErrDuplicateKey, ErrMissingDependency, ErrCycle,
+    ErrShadowedBlock, ErrParse, ErrExec, ErrBundle,
+  }
+  errs := []error{
+    &TemplateNotFoundError{}, &GenerationNotFoundError{}, &DuplicateTemplateError{}, &DuplicateKeyError{},
+    &MissingDependencyError{}, &CycleError{}, &ShadowedBlockError{}, &ParseError{}, &ExecError{}, &BundleError{},
+  }
+  for i, err := range errs {
+    for j, sentinel := range sentinels {
+      if errors.Is(err, sentinel) != (i == j) {
+        t.Errorf("expected errors.Is(%T, %v) to be %t", err, sentinel, i == j)
+      }
+    }
+  }
+}
+
+func TestErrorLines(t *testing.T) {
+  engines := map[string]func(...CacheOption) Cache{"html": HTMLCache, "text": TextCache}
+  for engine, newCache := range engines {
+    for _, newline := range []string{"\n", "\r\n"} {
+      files := map[string][]byte{
+        "base.tmpl": []byte("{{block \"content\" .}}{{end}}"),
+        "a.tmpl":    []byte("{{define \"a\"}}{{end}}"),
+        "b.tmpl":    []byte("{{define \"b\"}}{{end}}"),
+        "Page.tmpl": []byte(strings.Join([]string{
+          `{{extend "base"}}`,
+          `{{include "a`,
+          `  b"}}`,
+          ``,
+          `{{define "content"}}`,
+          `{{len 3}}`,
+          `{{end}}`,
+        }, newline)),
+      }
+
+      cache := newCache()
+      if err := cache.Load(PreloadedFiles(files)); err != nil {
+        t.Fatal(err)
+      }
+
+      var execErr *ExecError
+      _, err := cache.Builder("page").ExecStr()
+      if !errors.As(err, &execErr) || execErr.Name != "Page" || execErr.Path != "Page.tmpl" || execErr.Line != 6 {
+        t.Errorf("%s %q: expected ExecError at Page.tmpl:6, got %v", engine, newline, err)
+      } else if !strings.HasPrefix(execErr.Description, `executing "content"`) {
+        t.Errorf("%s %q: expected the description without the name and line, got %q", engine, newline,
+          execErr.Description)
+      }
+
+      files["Page.tmpl"] = []byte(strings.Join([]string{
+        `{{extend "base"}}`,
+        `{{include "a b"}}`,
+        ``,
+        `{{define "content"}}{{if}}{{end}}`,
+      }, newline))
+
+      var parseErr *ParseError
+      err = cache.Load(PreloadedFiles(files))
+      if !errors.As(err, &parseErr) || parseErr.Path != "Page.tmpl" || parseErr.Line != 4 {
+        t.Errorf("%s %q: expected ParseError at Page.tmpl:4, got %v", engine, newline, err)
+      } else if !strings.HasPrefix(err.Error(), "Page.tmpl:4: ") {
+        t.Errorf("%s %q: expected error to start with the file path and line, got %v", engine, newline, err)
+      }
+    }
+  }
+
+  // An error which does not come from a template keeps only its key.
+  set := &templateSet{}
+  if err := set.errExec("page", errors.New("write failed")); err.Name != "" || err.Line != 0 || err.Key != "page" {
+    t.Errorf("expected an unrecognised error message to leave the location empty, got %+v", err)
+  }
+}
+
+func TestStripDirective(t *testing.T) {
+  config := newCacheConfig()
+  for _, content := range []string{
+    "{{extend\n\"base\"}}\n\nrest",
+    "{{extend\r\n\"base\"}}\r\n\r\nrest",
+    "{{extend\r\"base\"}}\r\rrest",
+    "{{extend \"base\"}}\r\n\rrest",
+  } {
+    match := config.reExtend.FindIndex([]byte(content))
+    stripped := string(stripDirective([]byte(content), match, config))
+    breaks := strings.Join(reLineBreak.FindAllString(content[:match[1]], -1), "")
+    if expected := "{{/*" + breaks + "*/}}rest"; stripped != expected {
+      t.Errorf("expected %q to be stripped to %q, got %q", content, expected, stripped)
+    }
+  }
+}
+
+func TestValidate(t *testing.T) {
+  cache := TextCache()
+  if err := cache.Load(PreloadedFiles(map[string][]byte{"Page.tmpl": []byte(`ok`)})); err != nil {
+    t.Fatal(err)
+  }
+
+  err := cache.Validate(PreloadedFiles(map[string][]byte{
+    "a.tmpl":       nil,
+    "a.txt":        nil,
+    "Page.tmpl":    []byte(`{{extend "base"}}{{include "nav footer"}}`),
+    "nav.tmpl":     []byte(`{{define "nav"}}{{if}}{{end}}`),
+    "Cycle.tmpl":   []byte(`{{extend "parent"}}`),
+    "parent.tmpl":  []byte(`{{extend "Cycle"}}`),
+    "unused.tmpl":  []byte(`{{end}}`),
+    "Correct.tmpl": []byte(`ok`),
+  }))
+
+  var list ErrorList
+  if !errors.As(err, &list) {
+    t.Fatalf("expected ErrorList, got %v", err)
+  }
+
+  var duplicates, missing, cycles, parses int
+  for _, err := range list {
+    switch err.(type) {
+    case *DuplicateTemplateError:
+      duplicates++
+    case *MissingDependencyError:
+      missing++
+    case *CycleError:
+      cycles++
+    case *ParseError:
+      parses++
+    }
+  }
+  if duplicates != 1 || missing != 2 || cycles != 1 || parses != 2 || len(list) != 6 {
+    t.Errorf("unexpected errors: %v", err)
+  }
+
+  if str, err := cache.Builder("page").ExecStr(); err != nil || str != "ok" {
+    t.Errorf("validate replaced the loaded templates: %q, %v", str, err)
+  }
+
+  var cycle *CycleError
+  if !errors.Is(err, ErrCycle) || !errors.As(err, &cycle) || cycle.Chain[0] != "Cycle" {
+    t.Errorf("expected errors.Is and errors.As to find the cycle in the list, got %v", err)
+  }
+  if errors.Is(err, ErrShadowedBlock) {
+    t.Errorf("expected no shadowed blocks to be reported outside strict mode, got %v", err)
+  }
+
+  shadowing := map[string][]byte{
+    "nav.tmpl":     []byte(`{{define "menu"}}Nav{{end}}`),
+    "sidebar.tmpl": []byte(`{{define "menu"}}Sidebar{{end}}`),
+    "Page.tmpl":    []byte(`{{include "nav sidebar"}}{{template "menu"}}`),
+  }
+  if err := cache.Validate(PreloadedFiles(shadowing)); err != nil {
+    t.Errorf("expected shadowing to be allowed outside strict mode, got %v", err)
+  }
+  var shadowed *ShadowedBlockError
+  err = TextCache(StrictBlocks(true)).Validate(PreloadedFiles(shadowing))
+  if !errors.As(err, &shadowed) || shadowed.Template != "Page" || shadowed.Block != "menu" {
+    t.Errorf("expected ShadowedBlockError in strict mode, got %v", err)
+  }
+}
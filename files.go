@@ -1,16 +1,14 @@
 package marmot
 
 import (
-  "fmt"
   "io/ioutil"
   "os"
   "path/filepath"
-  "regexp"
-  "strings"
+  "sort"
 )
 
 // A FileCollection is something which can be used to generate a list of file paths.
-// Marmot provides three implementations: Directory, Paths and PreloadedFiles.
+// Marmot provides implementations including Directory, FS, Archive, HTTP, Paths, PreloadedFiles and MemoryFiles.
 type FileCollection interface {
   Resolve() (ResolvedFileCollection, error)
   Read(path string) ([]byte, error)
@@ -20,114 +18,63 @@ type ResolvedFileCollection struct {
   FileCollection
   Names []string
   Paths map[string]string
+  // Maps the name of a template to the hidden name of the template it shadows, for collections such as Overlay
+  // where one template can replace another with the same name. Hidden templates are not listed in Names and are
+  // never exported, but have paths in Paths. A template which extends or includes its own name uses the template
+  // it shadows.
+  Shadows map[string]string
+  // Maps the name of each template, including hidden ones, to the index of the layer which supplied it, for
+  // collections such as Overlay: 0 for the base collection, 1 for the first override and so on.
+  Layers map[string]int
+  // Maps the name of a template to the namespace which the names it extends and includes are relative to, for
+  // templates from a Namespace.
+  namespaces map[string]string
+  // Maps the name of a template to the path of its file in the collection it came from, for collections such as
+  // Overlay which qualify paths in Paths to tell apart the same path in different collections.
+  sources map[string]string
 }
 
 func (fc ResolvedFileCollection) Read(name string) ([]byte, error) {
   path, ok := fc.Paths[name]
   if !ok {
-    return nil, fmt.Errorf("could not load unknown template %s", name)
+    return nil, &MissingDependencyError{Name: name}
   }
   return fc.FileCollection.Read(path)
 }
 
-type Dir interface {
-  FileCollection
-  PartialMatch(pattern *regexp.Regexp) Dir
-  FullMatch(pattern *regexp.Regexp) Dir
-  MatchExtensions(extensions ...string) Dir
-}
-
-type directory struct {
-  path     string
-  patterns []*regexp.Regexp
-}
-
-// Creates a new FileCollection which walks the specified directory in order to generate a list of file paths.
-func Directory(path string) Dir {
-  return directory{path: filepath.Clean(path)}
-}
-
-// Files in the directory will be matched if the specified pattern appears anywhere in the file's path.
-// The paths checked against this pattern will be cleaned paths in slash format relative to the directory.
-func (d directory) PartialMatch(pattern *regexp.Regexp) Dir {
-  d.patterns = append(d.patterns, pattern)
-  return d
-}
-
-// Files in the directory will be matched if the entire path conforms to the specified pattern.
-// The paths checked against this pattern will be cleaned paths in slash format relative to the directory.
-func (d directory) FullMatch(pattern *regexp.Regexp) Dir {
-  d.patterns = append(d.patterns, regexp.MustCompile(fmt.Sprintf("^%s$", pattern.String())))
-  return d
-}
-
-// Files in the directory will be matched if they have any of the given extensions.
-// The extensions should exclude the leading dot.
-func (d directory) MatchExtensions(extensions ...string) Dir {
-  if len(extensions) == 0 {
-    return d
-  }
-  escapedExtensions := make([]string, len(extensions))
-  for i, extension := range extensions {
-    escapedExtensions[i] = regexp.QuoteMeta(extension)
+// Returns the path of the named template's file in the collection it came from, before any qualification.
+func (fc ResolvedFileCollection) sourcePath(name string) string {
+  if path, ok := fc.sources[name]; ok {
+    return path
   }
-  var pattern string
-  if len(escapedExtensions) > 1 {
-    pattern = fmt.Sprintf(`.*\.(%s)`, strings.Join(escapedExtensions, `|`))
-  } else {
-    pattern = fmt.Sprintf(`.*\.%s`, escapedExtensions[0])
-  }
-  d.patterns = append(d.patterns, regexp.MustCompile(pattern))
-  return d
-}
-
-func (d directory) Read(path string) ([]byte, error) {
-  return ioutil.ReadFile(path)
+  return fc.Paths[name]
 }
 
-func (d directory) Resolve() (ResolvedFileCollection, error) {
-  var names []string
-  paths := make(map[string]string)
-  err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
-    if err != nil {
-      return err
-    } else if info == nil || info.IsDir() {
-      return nil
-    }
-    path = filepath.Clean(path)
-    rel, err := filepath.Rel(d.path, path)
-    if err != nil {
-      return err
-    }
-    if !d.match(rel) {
-      return nil
-    }
-    name := relPathTemplateName(rel)
-    if dup, ok := paths[name]; ok {
-      return errDuplicateTemplate(name, dup, path)
+// Returns the names of every template, followed by the hidden names of the templates they shadow.
+func (fc ResolvedFileCollection) templateNames() []string {
+  if len(fc.Shadows) == 0 {
+    return fc.Names
+  }
+  names := append([]string(nil), fc.Names...)
+  for _, name := range fc.Names {
+    for hidden, ok := fc.Shadows[name]; ok; hidden, ok = fc.Shadows[hidden] {
+      names = append(names, hidden)
     }
-    paths[name] = path
-    names = append(names, name)
-    return nil
-  })
-  if err != nil {
-    return ResolvedFileCollection{}, err
   }
-  return ResolvedFileCollection{
-    FileCollection: d,
-    Names:          names,
-    Paths:          paths,
-  }, nil
+  return names
 }
 
-func (d directory) match(path string) bool {
-  slashPath := filepath.ToSlash(path)
-  for _, pattern := range d.patterns {
-    if !pattern.MatchString(slashPath) {
-      return false
+// Returns the name which a template was found with, before it was given a hidden name because another template
+// shadows it.
+func (fc ResolvedFileCollection) visibleName(name string) string {
+  for _, visible := range fc.Names {
+    for hidden, ok := visible, true; ok; hidden, ok = fc.Shadows[hidden] {
+      if hidden == name {
+        return visible
+      }
     }
   }
-  return true
+  return name
 }
 
 type pathList struct {
@@ -151,21 +98,16 @@ func (pl pathList) Read(path string) ([]byte, error) {
 }
 
 func (pl pathList) Resolve() (ResolvedFileCollection, error) {
-  var names []string
-  paths := make(map[string]string)
+  return resolveFirst(pl, defaultResolution)
+}
+
+func (pl pathList) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  r := newResolver()
   for _, path := range pl.paths {
-    name := relPathTemplateName(path)
-    if dup, ok := paths[name]; ok {
-      return ResolvedFileCollection{}, errDuplicateTemplate(name, dup, path)
-    }
-    paths[name] = filepath.Join(pl.root, path)
-    names = append(names, name)
+    fullPath := filepath.Join(pl.root, path)
+    r.add(res.rule.name(filepath.ToSlash(path)), fullPath, fullPath)
   }
-  return ResolvedFileCollection{
-    FileCollection: pl,
-    Names:          names,
-    Paths:          paths,
-  }, nil
+  return r.resolved(pl), r.duplicates, nil
 }
 
 type preloadedFiles struct {
@@ -179,34 +121,105 @@ func PreloadedFiles(data map[string][]byte) FileCollection {
 func (d preloadedFiles) Read(path string) ([]byte, error) {
   data, ok := d.data[path]
   if !ok {
-    return nil, fmt.Errorf("no data stored for %s", path)
+    return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
   }
   return data, nil
 }
 
 func (d preloadedFiles) Resolve() (ResolvedFileCollection, error) {
-  var names []string
-  paths := make(map[string]string)
-  for path, _ := range d.data {
+  return resolveFirst(d, defaultResolution)
+}
+
+func (d preloadedFiles) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  r := newResolver()
+  sorted := make([]string, 0, len(d.data))
+  for path := range d.data {
+    sorted = append(sorted, path)
+  }
+  sort.Strings(sorted)
+  for _, path := range sorted {
     path = filepath.Clean(path)
-    name := relPathTemplateName(path)
-    if dup, ok := paths[name]; ok {
-      return ResolvedFileCollection{}, errDuplicateTemplate(name, dup, path)
-    }
-    paths[name] = path
-    names = append(names, name)
+    r.add(res.rule.name(filepath.ToSlash(path)), path, path)
   }
-  return ResolvedFileCollection{
-    FileCollection: d,
-    Names:          names,
-    Paths:          paths,
-  }, nil
+  return r.resolved(d), r.duplicates, nil
 }
 
-func relPathTemplateName(path string) string {
-  return filepath.ToSlash(strings.TrimSuffix(path, filepath.Ext(path)))
+// Implemented by the FileCollections in this package. Rather than stopping at the first duplicate template name
+// like Resolve, resolveAll returns every duplicate alongside the templates which were resolved; the first file
+// found with each name is kept. The templates are named using the NameRule of the resolution. The error is only
+// non-nil if the collection could not be resolved at all.
+type allResolver interface {
+  resolveAll(res resolution) (ResolvedFileCollection, []error, error)
 }
 
-func errDuplicateTemplate(name, dup1, dup2 string) error {
-  return fmt.Errorf("duplicate template name %s used by both %s and %s", name, dup1, dup2)
+// The parameters of a single resolution of a FileCollection, which collections made of other collections pass on
+// to each of them.
+type resolution struct {
+  rule NameRule
+  // The files to resolve each MemoryFiles with in place of its current files, so that a change can be built by
+  // every subscribed Cache before it is applied.
+  staged map[*MemoryFiles]map[string][]byte
+}
+
+var defaultResolution = resolution{rule: DefaultNameRule}
+
+func resolveFirst(fc allResolver, res resolution) (ResolvedFileCollection, error) {
+  files, duplicates, err := fc.resolveAll(res)
+  if err != nil {
+    return ResolvedFileCollection{}, err
+  }
+  if len(duplicates) > 0 {
+    return ResolvedFileCollection{}, duplicates[0]
+  }
+  return files, nil
+}
+
+// Resolves the given FileCollection using the resolution's NameRule if the collection supports it.
+func resolveWith(fc FileCollection, res resolution) (ResolvedFileCollection, error) {
+  if all, ok := fc.(allResolver); ok {
+    return resolveFirst(all, res)
+  }
+  return fc.Resolve()
+}
+
+// Resolves the given FileCollection, returning every duplicate template name if the collection supports it.
+func resolveAll(fc FileCollection, res resolution) (ResolvedFileCollection, []error, error) {
+  if all, ok := fc.(allResolver); ok {
+    return all.resolveAll(res)
+  }
+  files, err := fc.Resolve()
+  return files, nil, err
+}
+
+// A resolver accumulates the names and paths of the templates in a FileCollection, recording any duplicate names.
+// The real paths, with any symbolic links resolved, are used to report duplicates.
+type resolver struct {
+  names      []string
+  paths      map[string]string
+  realPaths  map[string]string
+  duplicates []error
+}
+
+func newResolver() *resolver {
+  return &resolver{paths: make(map[string]string), realPaths: make(map[string]string)}
+}
+
+// Adds the template with the given name, returning false if a template with the same name has already been added.
+func (r *resolver) add(name, path, realPath string) bool {
+  if dup, ok := r.realPaths[name]; ok {
+    r.duplicates = append(r.duplicates, errDuplicateTemplate(name, dup, realPath))
+    return false
+  }
+  r.paths[name] = path
+  r.realPaths[name] = realPath
+  r.names = append(r.names, name)
+  return true
+}
+
+func (r *resolver) resolved(fc FileCollection) ResolvedFileCollection {
+  return ResolvedFileCollection{
+    FileCollection: fc,
+    Names:          r.names,
+    Paths:          r.paths,
+  }
 }
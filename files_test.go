@@ -0,0 +1,255 @@
+package marmot
+
+import (
+  "embed"
+  "errors"
+  "io/fs"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "testing"
+  "testing/fstest"
+)
+
+//go:embed testdata/html
+var testdataHTML embed.FS
+
+func TestFS(t *testing.T) {
+  cache := HTMLCache()
+  if err := cache.Load(FS(testdataHTML, "testdata/html").MatchExtensions("gohtml")); err != nil {
+    t.Fatal(err)
+  }
+
+  str, err := cache.Builder("Page").ExecStr()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !strings.Contains(str, "<p>Baa</p>") {
+    t.Errorf("incorrect html output: %s", str)
+  }
+
+  fsys := fstest.MapFS{
+    "templates/base.tmpl":        {Data: []byte(`Hello {{template "name"}}`)},
+    "templates/Page.tmpl":        {Data: []byte(`{{extend "base"}}{{define "name"}}world{{end}}`)},
+    "templates/drafts/Page.tmpl": {Data: []byte(`{{extend "base"}}{{define "name"}}draft{{end}}`)},
+    "templates/notes.txt":        {Data: []byte(`not a template`)},
+    "other/Unrelated.tmpl":       {Data: []byte(`unrelated`)},
+  }
+
+  files, err := FS(fsys, "templates").MatchExtensions("tmpl").Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  names := strings.Join(files.Names, " ")
+  if names != "Page base drafts/Page" || files.Paths["drafts/Page"] != "templates/drafts/Page.tmpl" {
+    t.Errorf("unexpected templates %v %v", files.Names, files.Paths)
+  }
+}
+
+func TestFilters(t *testing.T) {
+  fsys := fstest.MapFS{
+    "templates/.marmotignore": {
+      Data: []byte("# editor files\n*.swp\ndrafts/\n/examples\n!examples/Keep.tmpl\n"),
+    },
+    "templates/Page.tmpl":              {},
+    "templates/Page.tmpl.swp":          {},
+    "templates/drafts/Draft.tmpl":      {},
+    "templates/examples/Keep.tmpl":     {},
+    "templates/legacy/Old.tmpl":        {},
+    "templates/partials/nav.tmpl":      {},
+    "templates/partials/drafts/x.tmpl": {},
+    "templates/notes.txt":              {},
+  }
+
+  tests := []struct {
+    dir    Dir
+    expect string
+  }{
+    {FS(fsys, "templates"), "Page legacy/Old notes partials/nav"},
+    {FS(fsys, "templates").Glob("**/*.tmpl", "!legacy/**"), "Page partials/nav"},
+    {FS(fsys, "templates").Glob("*.tmpl").Exclude(regexp.MustCompile(`^partials/`)), "Page legacy/Old"},
+    {FS(fsys, "templates").Glob("/*.tmpl", "partials/"), "Page partials/nav"},
+    {FS(fsys, "templates").Glob("**/*.tmpl", "!partials/"), "Page legacy/Old"},
+    {FS(fsys, "templates").Glob("!legacy/**"), "Page notes partials/nav"},
+    {FS(fsys, "templates").Glob("!legacy/**", "!*.txt"), "Page partials/nav"},
+  }
+
+  for _, testData := range tests {
+    files, err := testData.dir.Resolve()
+    if err != nil {
+      t.Fatal(err)
+    }
+    if names := strings.Join(files.Names, " "); names != testData.expect {
+      t.Errorf("expected templates %s, got %s", testData.expect, names)
+    }
+  }
+
+  if _, err := FS(fsys, "templates").Glob("[a-").Resolve(); err == nil {
+    t.Error("expected invalid glob to fail")
+  }
+}
+
+func TestGlob(t *testing.T) {
+  tests := []struct {
+    glob    string
+    path    string
+    isDir   bool
+    matches bool
+  }{
+    {"*.gohtml", "a/b/c.gohtml", false, true},
+    {"*.gohtml", "c.html", false, false},
+    {"/*.gohtml", "a/c.gohtml", false, false},
+    {"a/*.gohtml", "a/c.gohtml", false, true},
+    {"a/*.gohtml", "b/a/c.gohtml", false, false},
+    {"**/a/*.gohtml", "b/a/c.gohtml", false, true},
+    {"a/**/c.gohtml", "a/c.gohtml", false, true},
+    {"a/**/c.gohtml", "a/x/y/c.gohtml", false, true},
+    {"legacy/**", "legacy/x/y.gohtml", false, true},
+    {"legacy/**", "legacy", true, false},
+    {"drafts/", "drafts", false, false},
+    {"drafts/", "x/drafts", true, true},
+    {"page?.[!a]*", "page1.b", false, true},
+    {"page?.[!a]*", "page1.a", false, false},
+    {`\#notes`, "#notes", false, true},
+    {`\!important`, "!important", false, true},
+  }
+
+  for _, testData := range tests {
+    rule, err := compileGlob(testData.glob)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if matched, _ := (globRules{rule}).match(testData.path, testData.isDir); matched != testData.matches {
+      t.Errorf("expected %s matching %s to be %t", testData.glob, testData.path, testData.matches)
+    }
+  }
+
+  rules, err := parseIgnoreFile([]byte("# comment\n\\#notes\n\\!important\n"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  expectIgnored := map[string]bool{"#notes": true, "!important": true, "important": false, "comment": false}
+  for path, ignored := range expectIgnored {
+    if rules.ignores(path, false) != ignored {
+      t.Errorf("expected ignoring %s to be %t", path, ignored)
+    }
+  }
+}
+
+func TestSymlinks(t *testing.T) {
+  tmp, err := ioutil.TempDir("", "marmot")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(tmp)
+
+  writeFile := func(path, content string) {
+    path = filepath.Join(tmp, filepath.FromSlash(path))
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+      t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  symlink := func(target, link string) {
+    if err := os.Symlink(filepath.Join(tmp, target), filepath.Join(tmp, link)); err != nil {
+      t.Skipf("symlinks not supported: %v", err)
+    }
+  }
+
+  writeFile("shared/nav.tmpl", `{{define "nav"}}<nav></nav>{{end}}`)
+  writeFile("app/Page.tmpl", `{{include "partials/nav"}}{{template "nav"}}`)
+  writeFile("other/Other.tmpl", `other`)
+  symlink("shared", "app/partials")
+  symlink("app", "app/loop")
+
+  files, err := Directory(filepath.Join(tmp, "app")).Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "Page" {
+    t.Errorf("expected symlinked directories to be skipped, got %s", names)
+  }
+
+  dir := Directory(filepath.Join(tmp, "app")).MatchExtensions("tmpl").FollowSymlinks()
+  files, err = dir.Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "Page partials/nav" {
+    t.Errorf("expected symlinked directory to be followed once, got %s", names)
+  }
+  if path := files.Paths["partials/nav"]; path != filepath.Join(tmp, "app", "partials", "nav.tmpl") {
+    t.Errorf("unexpected path %s", path)
+  }
+
+  cache := HTMLCache()
+  if err := cache.Load(dir); err != nil {
+    t.Fatal(err)
+  }
+  if str, err := cache.Builder("Page").ExecStr(); err != nil || str != "<nav></nav>" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+
+  files, err = Directories(filepath.Join(tmp, "app"), filepath.Join(tmp, "other")).MatchExtensions("tmpl").Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "Page Other" {
+    t.Errorf("expected templates from both roots, got %s", names)
+  }
+
+  app := Directory(filepath.Join(tmp, "app"))
+  if content, err := app.Read(filepath.Join(tmp, "app", "Page.tmpl")); err != nil || len(content) == 0 {
+    t.Errorf("expected to read a file in the directory, got %q %v", content, err)
+  }
+  if _, err := app.Read(filepath.Join(tmp, "other", "Other.tmpl")); !errors.Is(err, fs.ErrNotExist) {
+    t.Errorf("expected reading a file outside the directory to fail, got %v", err)
+  }
+
+  // Duplicates are reported by their real paths, including the same file found through two roots.
+  realShared, err := filepath.EvalSymlinks(filepath.Join(tmp, "shared"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  var dupErr *DuplicateTemplateError
+  dirs := Directories(filepath.Join(tmp, "shared"), filepath.Join(tmp, "app", "partials"))
+  if _, err := dirs.FollowSymlinks().Resolve(); !errors.As(err, &dupErr) ||
+    dupErr.DuplicatePath != filepath.Join(realShared, "nav.tmpl") {
+    t.Errorf("expected the same file through two roots to be a duplicate, got %v", err)
+  }
+  if _, err := Paths(".", "README.md", "README.md").Resolve(); !errors.As(err, &dupErr) {
+    t.Errorf("expected the same path given twice to be a duplicate, got %v", err)
+  }
+  writeFile("more/nav.tmpl", `<nav>more</nav>`)
+  _, err = Directories(filepath.Join(tmp, "app", "partials"), filepath.Join(tmp, "more")).FollowSymlinks().Resolve()
+  if !errors.As(err, &dupErr) {
+    t.Fatalf("expected a duplicate template error, got %v", err)
+  }
+  if dupErr.Path != filepath.Join(realShared, "nav.tmpl") {
+    t.Errorf("expected the duplicate to be reported by its real path, got %s", dupErr.Path)
+  }
+
+  // Sibling directories which link to each other are each followed once.
+  writeFile("mutual/a/X.tmpl", `x`)
+  writeFile("mutual/b/Y.tmpl", `y`)
+  symlink("mutual/b", "mutual/a/l")
+  symlink("mutual/a", "mutual/b/m")
+  files, err = Directory(filepath.Join(tmp, "mutual", "a")).FollowSymlinks().Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "X l/Y" {
+    t.Errorf("expected mutually linked directories to be followed once, got %s", names)
+  }
+  files, err = Directory(filepath.Join(tmp, "mutual")).FollowSymlinks().Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "a/X a/l/Y b/Y b/m/X" {
+    t.Errorf("expected mutually linked directories to be followed once from their parent, got %s", names)
+  }
+}
@@ -0,0 +1,117 @@
+package marmot
+
+import (
+  "sort"
+  "time"
+)
+
+// The default number of generations a Cache keeps, including the current one.
+const DefaultGenerationHistory = 5
+
+// A Generation describes one version of the templates loaded into a Cache. Every successful Cache.Load,
+// Cache.Refresh, Cache.Mount, Cache.Unmount, Cache.Rollback and update from a MemoryFiles creates a new generation,
+// numbered one more than the generation before it.
+type Generation struct {
+  // The generation's number. The first generation loaded is numbered 1.
+  Number int
+  // When the generation was loaded.
+  Loaded time.Time
+  // Whether the generation is the one currently used by Cache.Builder.
+  Current bool
+  // If the generation was created by Cache.Rollback, the number of the generation whose templates it uses again.
+  // Otherwise, it is 0.
+  RollbackOf int
+  // The hex-encoded SHA-256 hash of the file of every template read for the generation, indexed by template name:
+  // the exported templates and the templates they extend or include.
+  Hashes map[string]string
+}
+
+// Publishes the set as a new generation, making it current and adding it to the history. The update lock must be
+// held.
+func (c *templateCache) publish(set *templateSet) {
+  c.generation++
+  set.generation, set.loaded = c.generation, time.Now()
+  prev := c.history()
+  size := c.configuration().history
+  if size < 1 {
+    size = 1
+  }
+  start := 0
+  if len(prev)+1 > size {
+    start = len(prev) + 1 - size
+  }
+  history := make([]*templateSet, 0, len(prev)+1-start)
+  history = append(history, prev[start:]...)
+  history = append(history, set)
+  c.sets.Store(history)
+  c.current.Store(set)
+  if start > 0 {
+    c.dropLazy(prev[:start], history)
+  }
+}
+
+// Returns the sets of every generation in the history, oldest first. The slice must not be modified.
+func (c *templateCache) history() []*templateSet {
+  history, _ := c.sets.Load().([]*templateSet)
+  return history
+}
+
+// Returns the set of the given generation, or the current set if the generation is 0.
+func (c *templateCache) generationSet(generation int) (*templateSet, error) {
+  if generation == 0 {
+    return c.set(), nil
+  }
+  history := c.history()
+  i := sort.Search(len(history), func(i int) bool {
+    return history[i].generation >= generation
+  })
+  if i == len(history) || history[i].generation != generation {
+    return nil, &GenerationNotFoundError{Generation: generation}
+  }
+  return history[i], nil
+}
+
+func (c *templateCache) WithHistory(n int) Cache {
+  _ = c.configure(History(n))
+  return c
+}
+
+func (c *templateCache) Generation() int {
+  return c.set().generation
+}
+
+func (c *templateCache) Generations() []Generation {
+  current := c.set()
+  history := c.history()
+  generations := make([]Generation, len(history))
+  for i, set := range history {
+    hashes := make(map[string]string, len(set.data))
+    for name, data := range set.data {
+      hashes[name] = data.hash
+    }
+    generations[i] = Generation{
+      Number:     set.generation,
+      Loaded:     set.loaded,
+      Current:    set == current,
+      RollbackOf: set.rollbackOf,
+      Hashes:     hashes,
+    }
+  }
+  return generations
+}
+
+func (c *templateCache) Rollback(generation int) error {
+  c.update.Lock()
+  defer c.update.Unlock()
+  if generation == 0 {
+    return &GenerationNotFoundError{Generation: generation}
+  }
+  set, err := c.generationSet(generation)
+  if err != nil {
+    return err
+  }
+  rollback := *set
+  rollback.rollbackOf = set.generation
+  c.publish(&rollback)
+  return nil
+}
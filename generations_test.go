@@ -0,0 +1,118 @@
+package marmot
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "testing"
+)
+
+func TestGenerations(t *testing.T) {
+  files := NewMemoryFiles(map[string][]byte{
+    "base.tmpl":    []byte(`<{{template "content"}}>`),
+    "Home.tmpl":    []byte(`{{extend "base"}}{{define "content"}}home 1{{end}}`),
+    "Subject.tmpl": []byte(`subject 1`),
+  })
+  cache := TextCache(History(3))
+  if cache.Generation() != 0 || len(cache.Generations()) != 0 {
+    t.Errorf("expected no generations before loading, got %d", cache.Generation())
+  }
+  if err := cache.Load(files); err != nil {
+    t.Fatal(err)
+  }
+  files.Subscribe(cache)
+
+  expect := func(builder *Builder, output string) {
+    t.Helper()
+    if str, err := builder.ExecStr(); err != nil {
+      t.Error(err)
+    } else if str != output {
+      t.Errorf("expected %q, got %q", output, str)
+    }
+  }
+
+  pinned := cache.Generation()
+  if pinned != 1 {
+    t.Errorf("expected generation 1, got %d", pinned)
+  }
+  if err := files.Apply(
+    MemoryChange{Path: "Home.tmpl", Content: []byte(`{{extend "base"}}{{define "content"}}home 2{{end}}`)},
+    MemoryChange{Path: "Subject.tmpl", Content: []byte(`subject 2`)},
+  ); err != nil {
+    t.Fatal(err)
+  }
+  expect(cache.Builder("home").WithGeneration(pinned), "<home 1>")
+  expect(cache.Builder("subject").WithGeneration(pinned), "subject 1")
+  expect(cache.Builder("home"), "<home 2>")
+
+  generations := cache.Generations()
+  if len(generations) != 2 || generations[0].Number != 1 || generations[1].Number != 2 || !generations[1].Current {
+    t.Fatalf("unexpected generations %+v", generations)
+  }
+  hash := sha256.Sum256([]byte(`subject 2`))
+  if generations[1].Hashes["Subject"] != hex.EncodeToString(hash[:]) {
+    t.Errorf("unexpected hash %s", generations[1].Hashes["Subject"])
+  }
+  if generations[0].Hashes["base"] != generations[1].Hashes["base"] {
+    t.Error("expected the hash of an unchanged template to be the same")
+  }
+
+  latest := cache.Generation()
+  if err := cache.Rollback(1); err != nil {
+    t.Fatal(err)
+  }
+  expect(cache.Builder("home"), "<home 1>")
+  expect(cache.Builder("home").WithGeneration(latest), "<home 2>")
+  generations = cache.Generations()
+  if cache.Generation() != 3 || len(generations) != 3 || !generations[2].Current || generations[2].RollbackOf != 1 {
+    t.Errorf("expected the rollback to create generation 3, got %+v", generations)
+  }
+  if generations[2].Hashes["Subject"] != generations[0].Hashes["Subject"] {
+    t.Error("expected the rollback to use the templates of generation 1")
+  }
+  if err := cache.Rollback(2); err != nil {
+    t.Fatal(err)
+  }
+  expect(cache.Builder("home"), "<home 2>")
+  if cache.Generation() != 4 || cache.Generations()[0].Number != 2 {
+    t.Errorf("expected the rollback to create generation 4 and drop generation 1, got %+v", cache.Generations())
+  }
+
+  for i := 0; i < 3; i++ {
+    if err := cache.Load(files); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if generations := cache.Generations(); len(generations) != 3 || generations[0].Number != 5 {
+    t.Errorf("expected only the last 3 generations to be kept, got %+v", generations)
+  }
+  var notFound *GenerationNotFoundError
+  if err := cache.Rollback(pinned); !errors.As(err, &notFound) || notFound.Generation != pinned {
+    t.Errorf("expected rolling back to a dropped generation to fail, got %v", err)
+  }
+  if _, err := cache.Builder("home").WithGeneration(pinned).ExecStr(); !errors.As(err, &notFound) {
+    t.Errorf("expected executing a dropped generation to fail, got %v", err)
+  }
+
+  if err := cache.Reconfigure(History(1)); err != nil {
+    t.Fatal(err)
+  }
+  if generations := cache.Generations(); len(generations) != 1 || !generations[0].Current {
+    t.Errorf("expected reconfiguring the history to keep only the new generation, got %+v", generations)
+  }
+
+  defaults := TextCache()
+  for i := 0; i < DefaultGenerationHistory+1; i++ {
+    if err := defaults.Load(files); err != nil {
+      t.Fatal(err)
+    }
+    if i == 0 {
+      pinned = defaults.Generation()
+      continue
+    }
+    _, err := defaults.Builder("home").WithGeneration(pinned).ExecStr()
+    if (err == nil) != (i < DefaultGenerationHistory) {
+      t.Errorf("expected generation %d to be kept for %d loads, got %v", pinned, DefaultGenerationHistory, err)
+    }
+  }
+}
@@ -0,0 +1,174 @@
+package marmot
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "regexp"
+  "strings"
+)
+
+// The name of the file which can be placed at the root of a Directory or FS to exclude files from it, using the
+// same syntax as a .gitignore file.
+const IgnoreFileName = ".marmotignore"
+
+// A globRule is a single gitignore-style pattern.
+type globRule struct {
+  pattern *regexp.Regexp
+  negate  bool
+  dirOnly bool
+}
+
+// An ordered list of gitignore-style patterns. As with .gitignore files, the last rule which matches a path
+// decides whether it is matched or, if that rule is negated with a leading "!", not matched.
+type globRules []globRule
+
+// Compiles a gitignore-style pattern:
+//  - "*" matches anything except "/", "?" matches any single character except "/" and "[...]" matches a range
+//  - "**/" at the start of the pattern or "/**/" matches zero or more directories, and "/**" at the end of the
+//    pattern matches everything inside a directory
+//  - a leading "!" negates the pattern
+//  - a trailing "/" means the pattern only matches directories
+//  - a pattern containing a "/" anywhere but at the end is relative to the root, otherwise it matches at any level
+func compileGlob(glob string) (globRule, error) {
+  var rule globRule
+  if strings.HasPrefix(glob, "!") {
+    rule.negate, glob = true, glob[1:]
+  }
+  if strings.HasSuffix(glob, "/") {
+    rule.dirOnly, glob = true, strings.TrimSuffix(glob, "/")
+  }
+  anchored := strings.Contains(glob, "/")
+  glob = strings.TrimPrefix(glob, "/")
+
+  var re strings.Builder
+  re.WriteString("^")
+  if !anchored {
+    re.WriteString("(?:.*/)?")
+  }
+  for i := 0; i < len(glob); i++ {
+    switch c := glob[i]; {
+    case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+      re.WriteString("(?:.*/)?")
+      i += 2
+    case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+      re.WriteString(".*")
+      i++
+    case c == '*':
+      re.WriteString("[^/]*")
+    case c == '?':
+      re.WriteString("[^/]")
+    case c == '[':
+      end := strings.IndexByte(glob[i+1:], ']')
+      if end < 0 {
+        return rule, fmt.Errorf("unterminated character class in pattern %s", glob)
+      }
+      class := glob[i+1 : i+1+end]
+      if strings.HasPrefix(class, "!") {
+        class = "^" + class[1:]
+      }
+      re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+      i += 1 + end
+    case c == '\\' && i+1 < len(glob):
+      re.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+      i++
+    default:
+      re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+    }
+  }
+  re.WriteString("$")
+
+  pattern, err := regexp.Compile(re.String())
+  if err != nil {
+    return rule, fmt.Errorf("invalid pattern %s: %v", glob, err)
+  }
+  rule.pattern = pattern
+  return rule, nil
+}
+
+func compileGlobs(globs []string) (globRules, error) {
+  rules := make(globRules, 0, len(globs))
+  for _, glob := range globs {
+    rule, err := compileGlob(glob)
+    if err != nil {
+      return nil, err
+    }
+    rules = append(rules, rule)
+  }
+  return rules, nil
+}
+
+// Parses the contents of an ignore file. Blank lines and lines starting with "#" are skipped, and a leading "\"
+// escapes a "#" or "!" at the start of a pattern. An escaped "!" is left for compileGlob to read as a literal
+// character, since removing the "\" would make the pattern negated.
+func parseIgnoreFile(data []byte) (globRules, error) {
+  var globs []string
+  scanner := bufio.NewScanner(bytes.NewReader(data))
+  for scanner.Scan() {
+    line := strings.TrimRight(scanner.Text(), " \t\r")
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    if strings.HasPrefix(line, `\#`) {
+      line = line[1:]
+    }
+    globs = append(globs, line)
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  return compileGlobs(globs)
+}
+
+// Returns whether any rule matches the slash-separated path, and whether the last rule to match it was negated.
+func (rules globRules) match(path string, isDir bool) (matched, negated bool) {
+  for _, rule := range rules {
+    if rule.dirOnly && !isDir {
+      continue
+    }
+    if rule.pattern.MatchString(path) {
+      matched, negated = true, rule.negate
+    }
+  }
+  return matched, negated
+}
+
+// Returns whether any rule matches the slash-separated path of a file, and whether the last rule to match it was
+// negated. A rule which only matches directories matches a file if it matches any of the directories containing it.
+func (rules globRules) matchFile(path string) (matched, negated bool) {
+  for _, rule := range rules {
+    if rule.matchesFile(path) {
+      matched, negated = true, rule.negate
+    }
+  }
+  return matched, negated
+}
+
+func (rule globRule) matchesFile(path string) bool {
+  if !rule.dirOnly {
+    return rule.pattern.MatchString(path)
+  }
+  for i := 0; i < len(path); i++ {
+    if path[i] == '/' && rule.pattern.MatchString(path[:i]) {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns whether any of the rules is not negated. If none is, the rules only exclude paths, and paths which no rule
+// matches are included.
+func (rules globRules) includes() bool {
+  for _, rule := range rules {
+    if !rule.negate {
+      return true
+    }
+  }
+  return false
+}
+
+// Returns whether the rules, read as an ignore file, exclude the path.
+func (rules globRules) ignores(path string, isDir bool) bool {
+  matched, negated := rules.match(path, isDir)
+  return matched && !negated
+}
@@ -0,0 +1,230 @@
+package marmot
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "strconv"
+  "sync"
+)
+
+// A Graph describes the dependencies between the templates loaded into a Cache. It is a snapshot taken when
+// Cache.Graph is called, and is not updated by later loads.
+//
+// Templates which no exported template uses are not read when the templates are loaded. They are read the first time
+// Cache.Graph is called for the loaded templates, so their dependencies reflect their files at that time rather than
+// when the templates were loaded. Any errors reading them are returned by Graph.Err.
+//
+// Templates are identified by name: their path in forward slash format minus their extension, as used by extend
+// and include.
+type Graph struct {
+  names      []string
+  paths      map[string]string
+  data       map[string]*tpldata
+  deps       map[string]*dependencies
+  stacks     map[string][]string
+  nameRule   NameRule
+  keys       map[string]string
+  exported   []string
+  dependents map[string][]string
+  err        error
+}
+
+// The templates in a set which no exported template uses, which are read the first time the set's Graph is needed
+// rather than when the set is built. They are only read once, so that every Graph of the set is the same.
+type unusedTemplates struct {
+  once sync.Once
+  data map[string]*tpldata
+  errs ErrorList
+}
+
+// Reads the templates in the set which no exported template uses, if they have not been read already. A template
+// which cannot be read is given no dependencies, and its error is returned along with the others.
+func (set *templateSet) readUnused() (map[string]*tpldata, ErrorList) {
+  unused := set.unused
+  if unused == nil {
+    unused = &unusedTemplates{}
+  }
+  unused.once.Do(func() {
+    unused.data = make(map[string]*tpldata)
+    for _, name := range set.files.templateNames() {
+      if _, ok := set.data[name]; ok {
+        continue
+      }
+      loaded, err := loadTemplate(set.files, name, set.config)
+      if err != nil {
+        unused.errs = append(unused.errs, err)
+        loaded = tpldata{blocks: &blockDefs{}}
+      }
+      unused.data[name] = &loaded
+    }
+  })
+  return unused.data, unused.errs
+}
+
+func newGraph(set *templateSet) *Graph {
+  // Resolve the dependencies of every template, not just the exported ones. Templates which are not used by any
+  // exported template may have missing dependencies or cycles, which are skipped rather than failing.
+  names := set.files.templateNames()
+  unused, errs := set.readUnused()
+  data := make(map[string]*tpldata, len(names))
+  for _, name := range names {
+    if loaded, ok := set.data[name]; ok {
+      data[name] = loaded
+    } else {
+      data[name] = unused[name]
+    }
+  }
+  resolved := &templateSet{
+    files:    set.files,
+    data:     data,
+    deps:     make(map[string]*dependencies),
+    problems: &ErrorList{},
+  }
+  for _, name := range names {
+    _ = resolved.resolveDependencies(name, nil)
+  }
+
+  g := &Graph{
+    names:      names,
+    paths:      set.files.Paths,
+    data:       data,
+    deps:       resolved.deps,
+    stacks:     set.stacks,
+    nameRule:   set.nameRule,
+    keys:       make(map[string]string),
+    dependents: make(map[string][]string),
+  }
+  if len(errs) > 0 {
+    g.err = errs
+  }
+
+  for _, name := range g.names {
+    if _, ok := set.stacks[name]; ok {
+      g.keys[set.nameRule.key(name)] = name
+      g.exported = append(g.exported, name)
+    }
+    deps := g.deps[name]
+    for _, dep := range deps.extends {
+      g.dependents[dep] = append(g.dependents[dep], name)
+    }
+    for _, dep := range deps.includes {
+      g.dependents[dep] = append(g.dependents[dep], name)
+    }
+  }
+
+  return g
+}
+
+// Returns an ErrorList of the errors reading the templates which no exported template uses, or nil if they were all
+// read. The templates which could not be read are given no dependencies.
+func (g *Graph) Err() error {
+  return g.err
+}
+
+// Returns the names of all of the templates, in the order they were found in the FileCollection, followed by the
+// hidden names of any templates which are shadowed by others, as given by ResolvedFileCollection.Shadows.
+func (g *Graph) Templates() []string {
+  return copyStrings(g.names)
+}
+
+// Returns the names of the exported templates, which can be executed via Cache.Builder.
+func (g *Graph) Exported() []string {
+  return copyStrings(g.exported)
+}
+
+// Returns the path of the file of the named template, as given by ResolvedFileCollection.Paths.
+func (g *Graph) Path(name string) string {
+  return g.paths[name]
+}
+
+// Returns the templates which the named template extends directly, as listed in its {{extend}}.
+func (g *Graph) Extends(name string) []string {
+  if data, ok := g.data[name]; ok {
+    return copyStrings(data.extends)
+  }
+  return nil
+}
+
+// Returns the templates which the named template includes directly, as listed in its {{include}}.
+func (g *Graph) Includes(name string) []string {
+  if data, ok := g.data[name]; ok {
+    return copyStrings(data.includes)
+  }
+  return nil
+}
+
+// Returns every template which is parsed before the named template because it extends them: its ancestors,
+// along with the templates they include, in the order they are parsed.
+func (g *Graph) AllExtends(name string) []string {
+  if deps, ok := g.deps[name]; ok {
+    return copyStrings(deps.extends)
+  }
+  return nil
+}
+
+// Returns every template which is parsed after the named template because it includes them: the templates it
+// includes, along with their own ancestors and includes, in the order they are parsed.
+func (g *Graph) AllIncludes(name string) []string {
+  if deps, ok := g.deps[name]; ok {
+    return copyStrings(deps.includes)
+  }
+  return nil
+}
+
+// Returns every template which directly or indirectly extends or includes the named template. For example, the
+// dependents of a partial are all of the templates which would change if the partial was changed.
+func (g *Graph) Dependents(name string) []string {
+  return copyStrings(g.dependents[name])
+}
+
+// Returns the names of the templates which are parsed, in order, to build the exported template with the given
+// key. The key is matched in the same way as by Cache.Builder. If there is no exported template with the key, ok is
+// false.
+func (g *Graph) Stack(key string) (stack []string, ok bool) {
+  name, ok := g.keys[g.nameRule.key(key)]
+  if !ok {
+    return nil, false
+  }
+  return copyStrings(g.stacks[name]), true
+}
+
+// Writes the graph in the Graphviz DOT language. Exported templates are drawn as boxes, extends as solid edges
+// and includes as dashed edges.
+func (g *Graph) WriteDOT(w io.Writer) error {
+  buf := new(bytes.Buffer)
+  buf.WriteString("digraph templates {\n")
+  for _, name := range g.names {
+    attrs := fmt.Sprintf("tooltip=%s", strconv.Quote(g.paths[name]))
+    if _, ok := g.stacks[name]; ok {
+      attrs += ", shape=box"
+    }
+    fmt.Fprintf(buf, "  %s [%s];\n", strconv.Quote(name), attrs)
+  }
+  for _, name := range g.names {
+    for _, parent := range g.data[name].extends {
+      fmt.Fprintf(buf, "  %s -> %s [label=\"extends\"];\n", strconv.Quote(name), strconv.Quote(parent))
+    }
+    for _, included := range g.data[name].includes {
+      fmt.Fprintf(buf, "  %s -> %s [label=\"includes\", style=dashed];\n",
+        strconv.Quote(name), strconv.Quote(included))
+    }
+  }
+  buf.WriteString("}\n")
+  _, err := buf.WriteTo(w)
+  return err
+}
+
+// Returns the graph in the Graphviz DOT language, as written by Graph.WriteDOT.
+func (g *Graph) DOT() string {
+  buf := new(bytes.Buffer)
+  _ = g.WriteDOT(buf)
+  return buf.String()
+}
+
+func copyStrings(strs []string) []string {
+  if strs == nil {
+    return nil
+  }
+  return append([]string(nil), strs...)
+}
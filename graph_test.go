@@ -0,0 +1,71 @@
+package marmot
+
+import (
+  "errors"
+  "os"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestGraph(t *testing.T) {
+  cache := HTMLCache()
+  if err := cache.Load(Directory("testdata/html").MatchExtensions("gohtml")); err != nil {
+    t.Fatal(err)
+  }
+
+  graph := cache.Graph()
+
+  expect := func(what string, actual, expect []string) {
+    if !reflect.DeepEqual(actual, expect) {
+      t.Errorf("expected %s to be %v, got %v", what, expect, actual)
+    }
+  }
+
+  expect("exported", graph.Exported(), []string{"Page"})
+  expect("extends", graph.Extends("Page"), []string{"base"})
+  expect("includes", graph.Includes("Page"), []string{"foo", "baa"})
+  expect("all extends", graph.AllExtends("Page"), []string{"base", "libs/title"})
+  expect("all includes", graph.AllIncludes("Page"), []string{"foo", "baa", "libs/baaLib"})
+  expect("dependents", graph.Dependents("libs/baaLib"), []string{"Page", "baa"})
+
+  stack, ok := graph.Stack("page")
+  if !ok {
+    t.Fatal("expected stack for page")
+  }
+  expect("stack", stack, []string{"base", "libs/title", "Page", "foo", "baa", "libs/baaLib"})
+
+  dot := graph.DOT()
+  for _, line := range []string{
+    `"Page" [tooltip="testdata/html/Page.gohtml", shape=box];`,
+    `"Page" -> "base" [label="extends"];`,
+    `"baa" -> "libs/baaLib" [label="includes", style=dashed];`,
+  } {
+    if !strings.Contains(dot, line) {
+      t.Errorf("expected DOT output to contain %s, got:\n%s", line, dot)
+    }
+  }
+  if err := graph.Err(); err != nil {
+    t.Error(err)
+  }
+
+  files := map[string][]byte{
+    "Page.tmpl":   []byte(`page`),
+    "unused.tmpl": []byte(`{{include "a"}}`),
+    "broken.tmpl": []byte(`{{include "a"}}`),
+    "a.tmpl":      []byte(`a`),
+  }
+  cache = TextCache()
+  if err := cache.Load(PreloadedFiles(files)); err != nil {
+    t.Fatal(err)
+  }
+  delete(files, "broken.tmpl")
+  graph = cache.Graph()
+  expect("unused includes", graph.Includes("unused"), []string{"a"})
+  var errs ErrorList
+  if !errors.As(graph.Err(), &errs) || len(errs) != 1 || !errors.Is(errs[0], os.ErrNotExist) {
+    t.Errorf("expected the unreadable template to be reported, got %v", graph.Err())
+  }
+  files["unused.tmpl"] = []byte(`unused`)
+  expect("unused includes after editing", cache.Graph().Includes("unused"), []string{"a"})
+}
@@ -0,0 +1,205 @@
+package marmot
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/fs"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // The default path of the manifest of an HTTPFiles, relative to its base URL.
+  DefaultHTTPManifest = "manifest.json"
+
+  // The default time limit for each request made by an HTTPFiles, including reading the response body.
+  DefaultHTTPTimeout = 30 * time.Second
+)
+
+// The number of files an HTTPFiles downloads at once.
+const httpWorkers = 8
+
+// An HTTPFiles is a FileCollection which downloads templates from an HTTP server. To create an HTTPFiles, use HTTP.
+//
+// Every time the collection is resolved, it downloads a manifest listing the paths of the templates, relative to
+// the base URL, as a JSON array of strings:
+//  ["layout.gohtml", "pages/Home.gohtml", "partials/nav.gohtml"]
+//
+// It then downloads every template in the manifest. Downloaded files are kept in memory along with their ETags, and
+// when the collection is resolved again, the manifest and each file are only downloaded again if the server does
+// not respond to If-None-Match with 304 Not Modified.
+//
+// Templates are named by their paths in the manifest, in the same way as for PreloadedFiles, and the paths used in
+// errors are the templates' URLs. Since the URL of a template does not change when its content does, use Cache.Load
+// rather than Cache.Refresh to pick up every changed template.
+type HTTPFiles struct {
+  base     string
+  manifest string
+  timeout  time.Duration
+  client   *http.Client
+  lock     sync.Mutex
+  cached   map[string]httpFile
+}
+
+type httpFile struct {
+  etag    string
+  content []byte
+}
+
+// Creates a new HTTPFiles which downloads templates from the given base URL.
+func HTTP(baseURL string) *HTTPFiles {
+  return &HTTPFiles{
+    base:     strings.TrimSuffix(baseURL, "/"),
+    manifest: DefaultHTTPManifest,
+    timeout:  DefaultHTTPTimeout,
+    cached:   make(map[string]httpFile),
+  }
+}
+
+// Sets the path of the manifest, relative to the base URL. By default, it is DefaultHTTPManifest.
+func (h *HTTPFiles) WithManifest(path string) *HTTPFiles {
+  h.manifest = path
+  return h
+}
+
+// Sets the time limit for each request, including reading the response body. A timeout of zero means no time limit.
+// By default, the timeout is DefaultHTTPTimeout.
+func (h *HTTPFiles) WithTimeout(timeout time.Duration) *HTTPFiles {
+  h.timeout = timeout
+  return h
+}
+
+// Sets the http.Client used to make requests, for example to configure its transport. The client's own timeout is
+// replaced by the one given to HTTPFiles.WithTimeout. By default, http.DefaultClient is used.
+func (h *HTTPFiles) WithClient(client *http.Client) *HTTPFiles {
+  h.client = client
+  return h
+}
+
+func (h *HTTPFiles) Read(path string) ([]byte, error) {
+  h.lock.Lock()
+  file, ok := h.cached[path]
+  h.lock.Unlock()
+  if ok {
+    return file.content, nil
+  }
+  return h.fetch(path)
+}
+
+func (h *HTTPFiles) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(h, defaultResolution)
+}
+
+func (h *HTTPFiles) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  manifestData, err := h.fetch(h.url(h.manifest))
+  if err != nil {
+    return ResolvedFileCollection{}, nil, err
+  }
+  var manifest []string
+  if err := json.Unmarshal(manifestData, &manifest); err != nil {
+    return ResolvedFileCollection{}, nil, fmt.Errorf("%s: invalid manifest: %v", h.url(h.manifest), err)
+  }
+
+  urls := make([]string, len(manifest))
+  for i, filePath := range manifest {
+    cleaned := path.Clean(strings.TrimPrefix(filePath, "/"))
+    if !fs.ValidPath(cleaned) || cleaned == "." {
+      return ResolvedFileCollection{}, nil, fmt.Errorf("%s: invalid path %s in manifest", h.url(h.manifest), filePath)
+    }
+    manifest[i], urls[i] = cleaned, h.url(cleaned)
+  }
+
+  snapshot := httpSnapshot{HTTPFiles: h, files: make(map[string][]byte, len(urls))}
+  contents := make([][]byte, len(urls))
+  err = parallel(httpWorkers, len(urls), func(i int) (err error) {
+    contents[i], err = h.fetch(urls[i])
+    return err
+  })
+  if err != nil {
+    return ResolvedFileCollection{}, nil, err
+  }
+
+  r := newResolver()
+  for i, filePath := range manifest {
+    snapshot.files[urls[i]] = contents[i]
+    r.add(res.rule.name(filePath), urls[i], urls[i])
+  }
+
+  // Files which have been removed from the manifest are no longer needed.
+  h.lock.Lock()
+  for url := range h.cached {
+    if _, ok := snapshot.files[url]; !ok && url != h.url(h.manifest) {
+      delete(h.cached, url)
+    }
+  }
+  h.lock.Unlock()
+
+  return r.resolved(snapshot), r.duplicates, nil
+}
+
+func (h *HTTPFiles) url(filePath string) string {
+  return h.base + "/" + strings.TrimPrefix(filePath, "/")
+}
+
+// Downloads the file at the URL, unless the server reports that the copy already downloaded has not been modified.
+func (h *HTTPFiles) fetch(url string) ([]byte, error) {
+  req, err := http.NewRequest(http.MethodGet, url, nil)
+  if err != nil {
+    return nil, err
+  }
+  h.lock.Lock()
+  cached, ok := h.cached[url]
+  h.lock.Unlock()
+  if ok && cached.etag != "" {
+    req.Header.Set("If-None-Match", cached.etag)
+  }
+
+  client := http.Client{Timeout: h.timeout}
+  if h.client != nil {
+    client = *h.client
+    client.Timeout = h.timeout
+  }
+  resp, err := client.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer resp.Body.Close()
+
+  switch {
+  case resp.StatusCode == http.StatusNotModified && ok:
+    return cached.content, nil
+  case resp.StatusCode == http.StatusNotFound:
+    return nil, &os.PathError{Op: "get", Path: url, Err: os.ErrNotExist}
+  case resp.StatusCode != http.StatusOK:
+    return nil, fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+  }
+
+  content, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, fmt.Errorf("%s: %v", url, err)
+  }
+  h.lock.Lock()
+  h.cached[url] = httpFile{etag: resp.Header.Get("ETag"), content: content}
+  h.lock.Unlock()
+  return content, nil
+}
+
+// The FileCollection of a resolved HTTPFiles, which keeps reading the files downloaded when it was resolved.
+// Resolving it again downloads any files which have changed.
+type httpSnapshot struct {
+  *HTTPFiles
+  files map[string][]byte
+}
+
+func (s httpSnapshot) Read(url string) ([]byte, error) {
+  content, ok := s.files[url]
+  if !ok {
+    return nil, &os.PathError{Op: "read", Path: url, Err: os.ErrNotExist}
+  }
+  return content, nil
+}
@@ -0,0 +1,101 @@
+package marmot
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestHTTP(t *testing.T) {
+  var lock sync.Mutex
+  files := map[string]string{
+    "/templates/manifest.json":     `["base.tmpl", "pages/Home.tmpl"]`,
+    "/templates/base.tmpl":         `<{{template "content"}}>`,
+    "/templates/pages/Home.tmpl":   `{{extend "base"}}{{define "content"}}home{{end}}`,
+    "/templates/pages/Slow.tmpl":   `slow`,
+    "/templates/pages/About.tmpl":  `{{extend "base"}}{{define "content"}}about{{end}}`,
+    "/templates/other/manifest.js": `[]`,
+  }
+  versions := make(map[string]int)
+  downloads := make(map[string]int)
+
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    lock.Lock()
+    content, ok := files[r.URL.Path]
+    etag := fmt.Sprintf(`"%d"`, versions[r.URL.Path])
+    lock.Unlock()
+    if !ok {
+      http.NotFound(w, r)
+      return
+    }
+    if strings.HasSuffix(r.URL.Path, "Slow.tmpl") {
+      time.Sleep(200 * time.Millisecond)
+    }
+    w.Header().Set("ETag", etag)
+    if r.Header.Get("If-None-Match") == etag {
+      w.WriteHeader(http.StatusNotModified)
+      return
+    }
+    lock.Lock()
+    downloads[r.URL.Path]++
+    lock.Unlock()
+    _, _ = w.Write([]byte(content))
+  }))
+  defer server.Close()
+
+  remote := HTTP(server.URL + "/templates/")
+  cache := TextCache()
+  if err := cache.Load(remote); err != nil {
+    t.Fatal(err)
+  }
+  if str, err := cache.Builder("pages/home").ExecStr(); err != nil || str != "<home>" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+
+  lock.Lock()
+  files["/templates/manifest.json"] = `["base.tmpl", "pages/Home.tmpl", "pages/About.tmpl"]`
+  versions["/templates/manifest.json"]++
+  files["/templates/base.tmpl"] = `[{{template "content"}}]`
+  versions["/templates/base.tmpl"]++
+  lock.Unlock()
+
+  if err := cache.Load(remote); err != nil {
+    t.Fatal(err)
+  }
+  if str, err := cache.Builder("pages/about").ExecStr(); err != nil || str != "[about]" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+  lock.Lock()
+  for path, expect := range map[string]int{
+    "/templates/manifest.json":    2,
+    "/templates/base.tmpl":        2,
+    "/templates/pages/Home.tmpl":  1,
+    "/templates/pages/About.tmpl": 1,
+  } {
+    if downloads[path] != expect {
+      t.Errorf("expected %s to be downloaded %d times, got %d", path, expect, downloads[path])
+    }
+  }
+  lock.Unlock()
+
+  resolved, err := HTTP(server.URL + "/templates").WithManifest("other/manifest.js").Resolve()
+  if err != nil || len(resolved.Names) != 0 {
+    t.Errorf("expected an empty manifest, got %v %v", resolved.Names, err)
+  }
+
+  lock.Lock()
+  files["/templates/manifest.json"] = `["pages/Slow.tmpl"]`
+  versions["/templates/manifest.json"]++
+  lock.Unlock()
+  if _, err := HTTP(server.URL + "/templates").WithTimeout(50 * time.Millisecond).Resolve(); err == nil {
+    t.Error("expected a slow request to time out")
+  }
+
+  if _, err := HTTP(server.URL + "/missing").Resolve(); err == nil {
+    t.Error("expected a missing manifest to fail")
+  }
+}
@@ -0,0 +1,226 @@
+package marmot
+
+import (
+  "container/list"
+  "sync"
+)
+
+// A lazyTemplate is an exported template which is only compiled when it is first executed. Sets built by
+// Cache.Refresh share the lazyTemplates whose stacks have not changed, so their compiled templates carry over.
+type lazyTemplate struct {
+  name string
+  // The total size of the sources in the template's stack, which is used as an estimate of the size of the
+  // compiled template.
+  size int64
+  lock sync.Mutex
+  tpl  templateCreator
+  // The compilation in progress, if there is one, which concurrent executions wait for rather than compiling the
+  // template again.
+  call *compileCall
+  // The template's element in the compiledTemplates list, or nil if it is not compiled.
+  elem *list.Element
+  // Whether the template has been removed from the Cache because no set which uses it is kept. It is never added to
+  // the compiledTemplates list again, so that executions of a dropped set which are still running cannot leak it.
+  dropped bool
+  // The error from compiling the template, if it failed. The template's stack is fixed, so compiling it again would
+  // only fail in the same way.
+  err error
+}
+
+type compileCall struct {
+  done chan struct{}
+  tpl  templateCreator
+  err  error
+}
+
+// Returns the compiled template, compiling it if necessary. Only one compilation runs at a time; any executions
+// which need the template while it is being compiled wait for that compilation and share its result.
+func (t *lazyTemplate) template(
+  compiled *compiledTemplates, compile func() (templateCreator, error),
+) (templateCreator, error) {
+  t.lock.Lock()
+  if tpl := t.tpl; tpl != nil {
+    t.lock.Unlock()
+    compiled.touch(t)
+    return tpl, nil
+  }
+  if err := t.err; err != nil {
+    t.lock.Unlock()
+    return nil, err
+  }
+  if call := t.call; call != nil {
+    t.lock.Unlock()
+    <-call.done
+    return call.tpl, call.err
+  }
+  call := &compileCall{done: make(chan struct{})}
+  t.call = call
+  t.lock.Unlock()
+
+  call.tpl, call.err = compile()
+
+  t.lock.Lock()
+  t.call = nil
+  if call.err == nil {
+    t.tpl = call.tpl
+  } else {
+    t.err = call.err
+  }
+  t.lock.Unlock()
+  close(call.done)
+  if call.err == nil {
+    compiled.add(t)
+  }
+  return call.tpl, call.err
+}
+
+// The compiled lazyTemplates of a Cache, most recently used first. Once there are more than maxTemplates compiled
+// templates, or their sizes add up to more than maxBytes, the least recently used are evicted and will be compiled
+// again when they are next executed. A limit of zero means no limit.
+type compiledTemplates struct {
+  lock         sync.Mutex
+  list         *list.List
+  bytes        int64
+  maxTemplates int
+  maxBytes     int64
+}
+
+func newCompiledTemplates() *compiledTemplates {
+  return &compiledTemplates{list: list.New()}
+}
+
+func (c *compiledTemplates) add(t *lazyTemplate) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  t.lock.Lock()
+  if t.elem != nil || t.tpl == nil || t.dropped {
+    t.lock.Unlock()
+    return
+  }
+  t.elem = c.list.PushFront(t)
+  t.lock.Unlock()
+  c.bytes += t.size
+  c.evict()
+}
+
+func (c *compiledTemplates) touch(t *lazyTemplate) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  t.lock.Lock()
+  defer t.lock.Unlock()
+  if t.elem != nil {
+    c.list.MoveToFront(t.elem)
+  }
+}
+
+// Removes the templates from the list, for example because every set which used them has been dropped.
+func (c *compiledTemplates) remove(templates []*lazyTemplate) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  for _, t := range templates {
+    c.drop(t)
+    t.lock.Lock()
+    t.dropped = true
+    t.lock.Unlock()
+  }
+}
+
+func (c *compiledTemplates) setLimits(maxTemplates int, maxBytes int64) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  c.maxTemplates, c.maxBytes = maxTemplates, maxBytes
+  c.evict()
+}
+
+// Evicts the least recently used templates until the limits are met. The most recently used template is never
+// evicted, even if it is larger than maxBytes on its own. The lock must be held.
+func (c *compiledTemplates) evict() {
+  for c.list.Len() > 1 &&
+    ((c.maxTemplates > 0 && c.list.Len() > c.maxTemplates) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+    c.drop(c.list.Back().Value.(*lazyTemplate))
+  }
+}
+
+// Removes the template from the list and discards its compiled template. The lock must be held.
+func (c *compiledTemplates) drop(t *lazyTemplate) {
+  t.lock.Lock()
+  defer t.lock.Unlock()
+  if t.elem == nil {
+    return
+  }
+  c.list.Remove(t.elem)
+  c.bytes -= t.size
+  t.elem, t.tpl = nil, nil
+}
+
+// Adds a lazyTemplate to the set for every exported template, reusing the ones from prev whose stacks have not
+// changed.
+func (set *templateSet) prepareLazy(prev *templateSet, changed map[string]bool) {
+  set.lazy = make(map[string]*lazyTemplate)
+  for _, name := range set.files.Names {
+    stack, ok := set.stacks[name]
+    if !ok {
+      continue
+    }
+    key := set.nameRule.key(name)
+    if prev != nil && !stackChanged(prev.stacks[name], stack, changed) {
+      if t, ok := prev.lazy[key]; ok && t.name == name {
+        set.lazy[key] = t
+        continue
+      }
+    }
+    t := &lazyTemplate{name: name}
+    for _, dep := range stack {
+      t.size += int64(len(set.data[dep].content))
+    }
+    set.lazy[key] = t
+  }
+}
+
+// Compiles the lazily compiled template with the given key, if the set has one.
+func (c *templateCache) compile(set *templateSet, key string) (templateCreator, bool, error) {
+  t, ok := set.lazy[set.nameRule.key(key)]
+  if !ok {
+    return nil, false, nil
+  }
+  tpl, err := t.template(c.compiled, func() (templateCreator, error) {
+    tpl, err := c.parseStack(set, set.stacks[t.name])
+    if err != nil {
+      return nil, err.withTemplate(t.name)
+    }
+    return tpl, nil
+  })
+  return tpl, true, err
+}
+
+// Removes the compiled templates of the dropped sets from the Cache, unless they are shared with a set which is
+// still kept.
+func (c *templateCache) dropLazy(dropped, kept []*templateSet) {
+  inUse := make(map[*lazyTemplate]bool)
+  for _, set := range kept {
+    for _, t := range set.lazy {
+      inUse[t] = true
+    }
+  }
+  var unused []*lazyTemplate
+  for _, set := range dropped {
+    for _, t := range set.lazy {
+      if !inUse[t] {
+        unused = append(unused, t)
+      }
+    }
+  }
+  if len(unused) > 0 {
+    c.compiled.remove(unused)
+  }
+}
+
+func (c *templateCache) WithLazyCompilation(lazy bool) Cache {
+  _ = c.configure(LazyCompilation(lazy))
+  return c
+}
+
+func (c *templateCache) WithCompileLimit(templates int, bytes int64) Cache {
+  _ = c.configure(CompileLimit(templates, bytes))
+  return c
+}
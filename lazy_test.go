@@ -0,0 +1,110 @@
+package marmot
+
+import (
+  "errors"
+  "fmt"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// A templateCreator which counts the templates compiled from it, and waits before compiling each one.
+type countingCreator struct {
+  templateCreator
+  count *int32
+  delay time.Duration
+}
+
+func (cc countingCreator) Create(name, content string, config *cacheConfig) (templateCreator, error) {
+  atomic.AddInt32(cc.count, 1)
+  time.Sleep(cc.delay)
+  return cc.templateCreator.Create(name, content, config)
+}
+
+func TestLazyCompilation(t *testing.T) {
+  var count int32
+  creator := countingCreator{templateCreator: textTemplateCreator{}, count: &count, delay: 10 * time.Millisecond}
+  c := newTemplateCache(creator, LazyCompilation(true))
+  files := map[string][]byte{
+    "base.tmpl":   []byte(`<{{template "content"}}>`),
+    "Broken.tmpl": []byte(`{{extend "base"}}{{define "content"}}{{end`),
+  }
+  for i := 0; i < 5; i++ {
+    files[fmt.Sprintf("Page%d.tmpl", i)] = []byte(fmt.Sprintf(`{{extend "base"}}{{define "content"}}%d{{end}}`, i))
+  }
+  if err := c.Load(PreloadedFiles(files)); err != nil {
+    t.Fatal(err)
+  }
+  if count != 0 {
+    t.Errorf("expected no templates to be compiled by Load, got %d", count)
+  }
+
+  var wg sync.WaitGroup
+  for i := 0; i < 10; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if str, err := c.Builder("page0").ExecStr(); err != nil || str != "<0>" {
+        t.Errorf("unexpected output %q %v", str, err)
+      }
+    }()
+  }
+  wg.Wait()
+  if count != 1 {
+    t.Errorf("expected concurrent executions to compile the template once, got %d", count)
+  }
+
+  var parseErr *ParseError
+  if _, err := c.Builder("broken").ExecStr(); !errors.As(err, &parseErr) || parseErr.Template != "Broken" {
+    t.Errorf("expected a parse error when executing, got %v", err)
+  }
+  count = 0
+  if _, err := c.Builder("broken").ExecStr(); !errors.As(err, &parseErr) || count != 0 {
+    t.Errorf("expected the parse error to be kept rather than compiling again, got %d %v", count, err)
+  }
+
+  if err := c.configure(CompileLimit(2, 0)); err != nil {
+    t.Fatal(err)
+  }
+  for _, key := range []string{"page1", "page2", "page1", "page3"} {
+    if _, err := c.Builder(key).ExecStr(); err != nil {
+      t.Fatal(err)
+    }
+  }
+  set := c.set()
+  for key, compiled := range map[string]bool{"page0": false, "page1": true, "page2": false, "page3": true} {
+    if (set.lazy[key].tpl != nil) != compiled {
+      t.Errorf("expected %s compiled to be %t", key, compiled)
+    }
+  }
+  count = 0
+  if _, err := c.Builder("page2").ExecStr(); err != nil || count != 1 {
+    t.Errorf("expected an evicted template to be compiled again, got %d %v", count, err)
+  }
+
+  if err := c.configure(CompileLimit(0, 1)); err != nil {
+    t.Fatal(err)
+  }
+  if c.compiled.list.Len() != 1 {
+    t.Errorf("expected only the most recently used template to be kept, got %d", c.compiled.list.Len())
+  }
+
+  if err := c.configure(CompileLimit(0, 0)); err != nil {
+    t.Fatal(err)
+  }
+  files["Page4.tmpl"] = []byte(`{{extend "base"}}{{define "content"}}new{{end}}`)
+  if _, err := c.Builder("page1").ExecStr(); err != nil {
+    t.Fatal(err)
+  }
+  if err := c.Refresh("Page4"); err != nil {
+    t.Fatal(err)
+  }
+  count = 0
+  if _, err := c.Builder("page1").ExecStr(); err != nil || count != 0 {
+    t.Errorf("expected an unchanged template to stay compiled after a refresh, got %d %v", count, err)
+  }
+  if str, err := c.Builder("page4").ExecStr(); err != nil || str != "<new>" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+}
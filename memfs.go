@@ -0,0 +1,140 @@
+package marmot
+
+import (
+  "bytes"
+  "io"
+  "io/fs"
+  "path"
+  "sort"
+  "time"
+)
+
+// A memFS is a read-only, in-memory fs.FS. Directories are not stored explicitly, but are implied by the paths of
+// the files.
+type memFS struct {
+  files map[string]*memFileInfo
+  dirs  map[string][]fs.DirEntry
+}
+
+// Creates a new memFS from the given files, indexed by their slash-separated paths, which must be valid according
+// to fs.ValidPath.
+func newMemFS(files map[string][]byte, modTime time.Time) *memFS {
+  m := &memFS{
+    files: make(map[string]*memFileInfo),
+    dirs:  map[string][]fs.DirEntry{".": nil},
+  }
+  for name, data := range files {
+    info := &memFileInfo{name: path.Base(name), data: data, modTime: modTime}
+    m.files[name] = info
+    m.addEntry(path.Dir(name), info)
+  }
+  for _, entries := range m.dirs {
+    sort.Slice(entries, func(i, j int) bool {
+      return entries[i].Name() < entries[j].Name()
+    })
+  }
+  return m
+}
+
+// Adds an entry to a directory, creating the directory and adding it to its own parent if it does not yet exist.
+func (m *memFS) addEntry(dir string, entry *memFileInfo) {
+  entries, exists := m.dirs[dir]
+  m.dirs[dir] = append(entries, entry)
+  if !exists {
+    m.addEntry(path.Dir(dir), &memFileInfo{name: path.Base(dir), dir: true, modTime: entry.modTime})
+  }
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+  if info, ok := m.files[name]; ok {
+    return &memFile{info: info, Reader: bytes.NewReader(info.data)}, nil
+  }
+  if entries, ok := m.dirs[name]; ok {
+    return &memDir{info: &memFileInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+  }
+  return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+  if info, ok := m.files[name]; ok {
+    return append([]byte(nil), info.data...), nil
+  }
+  return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+  if entries, ok := m.dirs[name]; ok {
+    return append([]fs.DirEntry(nil), entries...), nil
+  }
+  return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+  if info, ok := m.files[name]; ok {
+    return info, nil
+  }
+  if _, ok := m.dirs[name]; ok {
+    return &memFileInfo{name: path.Base(name), dir: true}, nil
+  }
+  return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// A memFileInfo describes a file or directory in a memFS, and is both its fs.FileInfo and its fs.DirEntry.
+type memFileInfo struct {
+  name    string
+  data    []byte
+  dir     bool
+  modTime time.Time
+}
+
+func (i *memFileInfo) Name() string               { return i.name }
+func (i *memFileInfo) Size() int64                { return int64(len(i.data)) }
+func (i *memFileInfo) ModTime() time.Time         { return i.modTime }
+func (i *memFileInfo) IsDir() bool                { return i.dir }
+func (i *memFileInfo) Sys() interface{}           { return nil }
+func (i *memFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *memFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+func (i *memFileInfo) Mode() fs.FileMode {
+  if i.dir {
+    return fs.ModeDir | 0555
+  }
+  return 0444
+}
+
+type memFile struct {
+  info *memFileInfo
+  *bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memDir struct {
+  info    *memFileInfo
+  entries []fs.DirEntry
+  offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+  return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+  remaining := d.entries[d.offset:]
+  if n <= 0 {
+    d.offset = len(d.entries)
+    return append([]fs.DirEntry(nil), remaining...), nil
+  }
+  if len(remaining) == 0 {
+    return nil, io.EOF
+  }
+  if n > len(remaining) {
+    n = len(remaining)
+  }
+  d.offset += n
+  return append([]fs.DirEntry(nil), remaining[:n]...), nil
+}
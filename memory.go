@@ -0,0 +1,169 @@
+package marmot
+
+import (
+  "os"
+  "path"
+  "sort"
+  "strings"
+  "sync"
+)
+
+// A MemoryFiles is a FileCollection of templates held in memory which can be changed at any time, such as templates
+// stored in a database and edited through a CMS. It is safe for concurrent use.
+//
+// Paths are slash-separated, and templates are named by their paths in the same way as for PreloadedFiles. Every
+// change is applied to the Caches subscribed with MemoryFiles.Subscribe, which rebuild only the templates affected by
+// the change. If any of them fails to rebuild, the change is rejected: the MemoryFiles is left as it was, and every
+// Cache keeps serving its previous templates.
+type MemoryFiles struct {
+  // Held while a change is applied, so that changes are applied one at a time.
+  update sync.Mutex
+  lock   sync.RWMutex
+  data   map[string][]byte
+  caches []Cache
+}
+
+// A MemoryChange is a single change to a MemoryFiles, made as part of a batch by MemoryFiles.Apply.
+type MemoryChange struct {
+  Path    string
+  Content []byte
+  // If true, the file at the path is deleted and the content is ignored.
+  Delete bool
+}
+
+// Creates a new MemoryFiles containing a copy of the given files, indexed by their paths.
+func NewMemoryFiles(data map[string][]byte) *MemoryFiles {
+  m := &MemoryFiles{data: make(map[string][]byte, len(data))}
+  for path, content := range data {
+    m.data[cleanMemoryPath(path)] = append([]byte(nil), content...)
+  }
+  return m
+}
+
+// Adds the given Caches to those which are rebuilt whenever the MemoryFiles changes. Each Cache should already have
+// loaded the MemoryFiles, either directly or as part of another FileCollection such as an Overlay or a mount.
+func (m *MemoryFiles) Subscribe(caches ...Cache) {
+  m.update.Lock()
+  defer m.update.Unlock()
+  m.caches = append(m.caches, caches...)
+}
+
+// Sets the content of the file at the given path, creating the file if it does not exist.
+func (m *MemoryFiles) Put(path string, content []byte) error {
+  return m.Apply(MemoryChange{Path: path, Content: content})
+}
+
+// Deletes the file at the given path, if it exists.
+func (m *MemoryFiles) Delete(path string) error {
+  return m.Apply(MemoryChange{Path: path, Delete: true})
+}
+
+// Applies the changes, in order, as a single change: the subscribed Caches are rebuilt once, and if any of them
+// fails to rebuild then none of the changes are kept.
+//
+// The Caches are rebuilt with the changed files before the change is applied, so that nothing else reading the
+// MemoryFiles sees a change which might be rejected. If a Cache is loaded or refreshed by something else while the
+// change is being applied, it is rebuilt again from its new templates once the change has been applied; if that
+// fails, the error is returned, but the change is kept by the MemoryFiles and the other Caches.
+func (m *MemoryFiles) Apply(changes ...MemoryChange) error {
+  m.update.Lock()
+  defer m.update.Unlock()
+
+  m.lock.RLock()
+  prevData := m.data
+  m.lock.RUnlock()
+  data := make(map[string][]byte, len(prevData)+len(changes))
+  for path, content := range prevData {
+    data[path] = content
+  }
+  changed := make(map[string]bool)
+  for _, change := range changes {
+    path := cleanMemoryPath(change.Path)
+    if change.Delete {
+      delete(data, path)
+    } else {
+      data[path] = append([]byte(nil), change.Content...)
+    }
+    changed[path] = true
+  }
+
+  staged := map[*MemoryFiles]map[string][]byte{m: data}
+  prev := make([]*templateSet, len(m.caches))
+  next := make([]*templateSet, len(m.caches))
+  for i, cache := range m.caches {
+    var err error
+    if prev[i], next[i], err = cache.rebuildPaths(changed, staged); err != nil {
+      return err
+    }
+  }
+
+  m.lock.Lock()
+  m.data = data
+  m.lock.Unlock()
+  // The change has been kept, so every Cache is updated even if rebuilding one of them again fails, and the first
+  // error is returned once they all have been.
+  var firstErr error
+  for i, cache := range m.caches {
+    // A Cache whose templates changed while it was being rebuilt is rebuilt again from its new templates, which now
+    // resolve the changed files without staging them.
+    for next[i] != nil && !cache.swapSet(prev[i], next[i]) {
+      var err error
+      if prev[i], next[i], err = cache.rebuildPaths(changed, nil); err != nil {
+        if firstErr == nil {
+          firstErr = err
+        }
+        break
+      }
+    }
+  }
+  return firstErr
+}
+
+func (m *MemoryFiles) Read(path string) ([]byte, error) {
+  m.lock.RLock()
+  defer m.lock.RUnlock()
+  return memorySnapshot{data: m.data}.Read(path)
+}
+
+func (m *MemoryFiles) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(m, defaultResolution)
+}
+
+func (m *MemoryFiles) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  m.lock.RLock()
+  data := m.data
+  m.lock.RUnlock()
+  if staged, ok := res.staged[m]; ok {
+    data = staged
+  }
+
+  sorted := make([]string, 0, len(data))
+  for path := range data {
+    sorted = append(sorted, path)
+  }
+  sort.Strings(sorted)
+  r := newResolver()
+  for _, path := range sorted {
+    r.add(res.rule.name(path), path, path)
+  }
+  return r.resolved(memorySnapshot{MemoryFiles: m, data: data}), r.duplicates, nil
+}
+
+// The FileCollection of a resolved MemoryFiles, which keeps reading the files as they were when it was resolved.
+// Resolving it again resolves the current files.
+type memorySnapshot struct {
+  *MemoryFiles
+  data map[string][]byte
+}
+
+func (s memorySnapshot) Read(path string) ([]byte, error) {
+  content, ok := s.data[cleanMemoryPath(path)]
+  if !ok {
+    return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+  }
+  return content, nil
+}
+
+func cleanMemoryPath(p string) string {
+  return strings.TrimPrefix(path.Clean(p), "/")
+}
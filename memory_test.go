@@ -0,0 +1,148 @@
+package marmot
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestMemoryFiles(t *testing.T) {
+  files := NewMemoryFiles(map[string][]byte{
+    "base.tmpl":  []byte(`<{{template "content"}}>`),
+    "Home.tmpl":  []byte(`{{extend "base"}}{{define "content"}}home{{end}}`),
+    "About.tmpl": []byte(`{{extend "base"}}{{define "content"}}about{{end}}`),
+  })
+
+  cache := TextCache()
+  if err := cache.Load(files); err != nil {
+    t.Fatal(err)
+  }
+  mounted := TextCache()
+  if err := mounted.Mount("cms", Overlay(PreloadedFiles(map[string][]byte{"Home.tmpl": nil}), files)); err != nil {
+    t.Fatal(err)
+  }
+  files.Subscribe(cache, mounted)
+
+  expect := func(cache Cache, key, output string) {
+    str, err := cache.Builder(key).ExecStr()
+    if err != nil {
+      t.Error(err)
+    } else if str != output {
+      t.Errorf("expected %q for %s, got %q", output, key, str)
+    }
+  }
+
+  about := cache.(*templateCache).set().templates["about"]
+  if err := files.Put("Home.tmpl", []byte(`{{extend "base"}}{{define "content"}}new home{{end}}`)); err != nil {
+    t.Fatal(err)
+  }
+  expect(cache, "home", "<new home>")
+  expect(mounted, "cms/home", "<new home>")
+  if cache.(*templateCache).set().templates["about"] != about {
+    t.Error("expected unaffected templates not to be rebuilt")
+  }
+
+  var parseErr *ParseError
+  if err := files.Put("Home.tmpl", []byte(`{{extend "base"}}{{define "content"}}{{end`)); !errors.As(err, &parseErr) {
+    t.Errorf("expected a parse error, got %v", err)
+  }
+  expect(cache, "home", "<new home>")
+  expect(mounted, "cms/home", "<new home>")
+  content, _ := files.Read("Home.tmpl")
+  if string(content) != `{{extend "base"}}{{define "content"}}new home{{end}}` {
+    t.Errorf("expected the rejected change not to be kept, got %s", content)
+  }
+
+  err := files.Apply(
+    MemoryChange{Path: "layout.tmpl", Content: []byte(`[{{template "content"}}]`)},
+    MemoryChange{Path: "About.tmpl", Content: []byte(`{{extend "layout"}}{{define "content"}}about{{end}}`)},
+    MemoryChange{Path: "/Contact.tmpl", Content: []byte(`contact`)},
+  )
+  if err != nil {
+    t.Fatal(err)
+  }
+  expect(cache, "about", "[about]")
+  expect(cache, "contact", "contact")
+
+  var missingErr *MissingDependencyError
+  if err := files.Delete("layout.tmpl"); !errors.As(err, &missingErr) {
+    t.Errorf("expected deleting a template in use to fail, got %v", err)
+  }
+  if err := files.Delete("Contact.tmpl"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := cache.Builder("contact").ExecStr(); err == nil {
+    t.Error("expected deleted template to be removed")
+  }
+}
+
+// A templateCreator which calls a function before compiling each template.
+type hookCreator struct {
+  templateCreator
+  hook func(name string)
+}
+
+func (hc hookCreator) Create(name, content string, config *cacheConfig) (templateCreator, error) {
+  hc.hook(name)
+  return hc.templateCreator.Create(name, content, config)
+}
+
+func TestMemoryFilesApply(t *testing.T) {
+  files := NewMemoryFiles(map[string][]byte{"Home.tmpl": []byte(`old`)})
+  other := TextCache()
+  if err := other.Load(files); err != nil {
+    t.Fatal(err)
+  }
+
+  // While the subscribed Caches are rebuilt, the change is not visible to anything else. The second Cache loads
+  // the first again during the rebuild, so the first has to be rebuilt again once the change has been applied.
+  var armed, reloaded bool
+  var seen string
+  hooked := newTemplateCache(hookCreator{templateCreator: textTemplateCreator{}, hook: func(name string) {
+    if armed {
+      armed = false
+      content, _ := files.Read("Home.tmpl")
+      seen, reloaded = string(content), other.Load(files) == nil
+    }
+  }})
+  if err := hooked.Load(files); err != nil {
+    t.Fatal(err)
+  }
+  files.Subscribe(other, hooked)
+
+  armed = true
+  if err := files.Put("Home.tmpl", []byte(`new`)); err != nil {
+    t.Fatal(err)
+  }
+  if seen != "old" || !reloaded {
+    t.Errorf("expected the change to be hidden while rebuilding, got %q", seen)
+  }
+  for _, cache := range []Cache{other, hooked} {
+    if str, err := cache.Builder("home").ExecStr(); err != nil || str != "new" {
+      t.Errorf("expected every Cache to have the change, got %q %v", str, err)
+    }
+  }
+
+  // If rebuilding a Cache again fails, the Caches after it still get the change.
+  failing, elsewhere := TextCache(), NewMemoryFiles(map[string][]byte{"Home.tmpl": []byte(`elsewhere`)})
+  last := newTemplateCache(hookCreator{templateCreator: textTemplateCreator{}, hook: func(name string) {
+    if armed {
+      armed = false
+      reloaded = failing.Load(elsewhere) == nil && elsewhere.Put("Home.tmpl", []byte(`{{end`)) == nil
+    }
+  }})
+  files = NewMemoryFiles(map[string][]byte{"Home.tmpl": []byte(`old`)})
+  for _, cache := range []Cache{failing, last} {
+    if err := cache.Load(files); err != nil {
+      t.Fatal(err)
+    }
+  }
+  files.Subscribe(failing, last)
+  armed = true
+  var parseErr *ParseError
+  if err := files.Put("Home.tmpl", []byte(`newer`)); !errors.As(err, &parseErr) || !reloaded {
+    t.Errorf("expected rebuilding the reloaded Cache to fail, got %v", err)
+  }
+  if str, err := last.Builder("home").ExecStr(); err != nil || str != "newer" {
+    t.Errorf("expected the Cache after the failure to have the change, got %q %v", str, err)
+  }
+}
@@ -0,0 +1,70 @@
+package marmot
+
+import (
+  "path"
+  "strings"
+)
+
+// A NameRule controls how the templates in a FileCollection are named, and how an exported template is found from
+// the key given to Cache.Builder. A nil function uses the default behaviour.
+//
+// The rule only applies to the FileCollections provided by this package, which pass it the path of each template
+// relative to the collection. Other FileCollections name their own templates in Resolve.
+type NameRule struct {
+  // Returns the name of the template at the given path, which is relative to the collection and in forward slash
+  // format. The name is used by extend and include. By default, the name is the path minus its last extension.
+  Name func(relPath string) string
+  // Returns the key of the exported template with the given name. Cache.Builder finds a template by converting the
+  // key it is given with the same function. By default, keys are case insensitive.
+  Key func(name string) string
+}
+
+// The NameRule used by a Cache unless it is configured with another: templates are named by their path minus its last
+// extension, and keys are case insensitive.
+var DefaultNameRule = NameRule{Name: TrimExtension, Key: CaseInsensitiveKey}
+
+// A NameRule which names templates in the default way, but whose keys are case sensitive, so that templates named
+// Foo and foo can both be exported.
+var CaseSensitiveNameRule = NameRule{Name: TrimExtension, Key: CaseSensitiveKey}
+
+// Names a template by its path minus its last extension, so emails/welcome.html.tmpl is named emails/welcome.html.
+func TrimExtension(relPath string) string {
+  return strings.TrimSuffix(relPath, path.Ext(relPath))
+}
+
+// Names a template by its path minus all of the extensions of its file name, so emails/welcome.html.tmpl is named
+// emails/welcome. A file name starting with a dot keeps its first part.
+func TrimAllExtensions(relPath string) string {
+  dir, file := path.Split(relPath)
+  if file == "" {
+    return relPath
+  }
+  if i := strings.IndexByte(file[1:], '.'); i >= 0 {
+    file = file[:i+1]
+  }
+  return dir + file
+}
+
+// Finds exported templates by their names, ignoring case.
+func CaseInsensitiveKey(name string) string {
+  return strings.ToLower(name)
+}
+
+// Finds exported templates by their exact names.
+func CaseSensitiveKey(name string) string {
+  return name
+}
+
+func (rule NameRule) name(relPath string) string {
+  if rule.Name == nil {
+    return TrimExtension(relPath)
+  }
+  return rule.Name(relPath)
+}
+
+func (rule NameRule) key(name string) string {
+  if rule.Key == nil {
+    return CaseInsensitiveKey(name)
+  }
+  return rule.Key(name)
+}
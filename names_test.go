@@ -0,0 +1,65 @@
+package marmot
+
+import (
+  "errors"
+  "testing"
+)
+
+func TestNameRules(t *testing.T) {
+  tests := []struct {
+    path   string
+    expect string
+  }{
+    {"emails/welcome.html.tmpl", "emails/welcome"},
+    {"emails/welcome", "emails/welcome"},
+    {"emails/.hidden.tmpl", "emails/.hidden"},
+    {"a.b/c.d.e", "a.b/c"},
+  }
+  for _, testData := range tests {
+    if name := TrimAllExtensions(testData.path); name != testData.expect {
+      t.Errorf("expected %s to be named %s, got %s", testData.path, testData.expect, name)
+    }
+  }
+
+  files := PreloadedFiles(map[string][]byte{
+    "emails/base.html.tmpl":    []byte(`Hello {{template "content"}}`),
+    "emails/Welcome.html.tmpl": []byte(`{{extend "emails/base"}}{{define "content"}}welcome{{end}}`),
+  })
+  cache := TextCache(NameRule{Name: TrimAllExtensions})
+  if err := cache.Load(files); err != nil {
+    t.Fatal(err)
+  }
+  if str, err := cache.Builder("emails/welcome").ExecStr(); err != nil || str != "Hello welcome" {
+    t.Errorf("unexpected output %q %v", str, err)
+  }
+
+  files = PreloadedFiles(map[string][]byte{
+    "Foo.tmpl": []byte(`Foo`),
+    "foo.tmpl": []byte(`foo`),
+  })
+  exportAll := ExportRule(func(string) TemplateType { return Exported })
+
+  var keyErr *DuplicateKeyError
+  if err := TextCache(exportAll).Load(files); !errors.As(err, &keyErr) {
+    t.Errorf("expected a duplicate key error, got %v", err)
+  } else if keyErr.Key != "foo" || keyErr.Name != "Foo" || keyErr.DuplicateName != "foo" {
+    t.Errorf("unexpected duplicate key error %v", keyErr)
+  }
+  if err := TextCache(exportAll).Validate(files); !errors.As(err, &keyErr) {
+    t.Errorf("expected validation to report a duplicate key, got %v", err)
+  }
+
+  cache = TextCache(exportAll, CaseSensitiveNameRule)
+  if err := cache.Load(files); err != nil {
+    t.Fatal(err)
+  }
+  for _, key := range []string{"Foo", "foo"} {
+    if str, err := cache.Builder(key).ExecStr(); err != nil || str != key {
+      t.Errorf("expected %s for key %s, got %q %v", key, key, str, err)
+    }
+  }
+  var notFound *TemplateNotFoundError
+  if _, err := cache.Builder("FOO").ExecStr(); !errors.As(err, &notFound) {
+    t.Errorf("expected case sensitive keys, got %v", err)
+  }
+}
@@ -0,0 +1,285 @@
+package marmot
+
+import (
+  "fmt"
+  "os"
+  "strings"
+)
+
+// Creates a new FileCollection whose templates are named by the prefix followed by a "/" and their name in the
+// given collection, so that the template customer/Checkout in the collection is named email/customer/Checkout with
+// the prefix "email".
+//
+// The extends and includes of the templates in the collection are relative to the prefix, so they do not need to
+// change when the collection is namespaced. A name starting with "/" refers to a template outside of the namespace
+// by its full name, for example {{extend "/web/layout"}}.
+func Namespace(prefix string, fc FileCollection) FileCollection {
+  return namespace{prefix: strings.Trim(prefix, "/"), fc: fc}
+}
+
+type namespace struct {
+  prefix string
+  fc     FileCollection
+}
+
+func (ns namespace) Read(path string) ([]byte, error) {
+  return ns.fc.Read(path)
+}
+
+func (ns namespace) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(ns, defaultResolution)
+}
+
+func (ns namespace) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  files, duplicates, err := resolveAll(ns.fc, res)
+  if err != nil || ns.prefix == "" {
+    return files, duplicates, err
+  }
+  qualify := func(name string) string {
+    return ns.prefix + "/" + name
+  }
+  resolved := ResolvedFileCollection{
+    FileCollection: resolvedNamespace{namespace: ns, fc: files.FileCollection},
+    Names:          make([]string, len(files.Names)),
+    Paths:          make(map[string]string, len(files.Paths)),
+    namespaces:     make(map[string]string, len(files.Paths)),
+  }
+  for i, name := range files.Names {
+    resolved.Names[i] = qualify(name)
+  }
+  if len(files.sources) > 0 {
+    resolved.sources = make(map[string]string, len(files.sources))
+    for name, path := range files.sources {
+      resolved.sources[qualify(name)] = path
+    }
+  }
+  for name, path := range files.Paths {
+    resolved.Paths[qualify(name)] = path
+    resolved.namespaces[qualify(name)] = ns.prefix
+    if inner := files.namespaces[name]; inner != "" {
+      resolved.namespaces[qualify(name)] = qualify(inner)
+    }
+  }
+  if len(files.Shadows) > 0 {
+    resolved.Shadows = make(map[string]string, len(files.Shadows))
+    for name, hidden := range files.Shadows {
+      resolved.Shadows[qualify(name)] = qualify(hidden)
+    }
+  }
+  for i, err := range duplicates {
+    if dupErr, ok := err.(*DuplicateTemplateError); ok {
+      withPrefix := *dupErr
+      withPrefix.Name = qualify(dupErr.Name)
+      duplicates[i] = &withPrefix
+    }
+  }
+  return resolved, duplicates, nil
+}
+
+// The FileCollection of a resolved namespace. Resolving it again resolves the namespaced collection again.
+type resolvedNamespace struct {
+  namespace
+  fc FileCollection
+}
+
+func (ns resolvedNamespace) Read(path string) ([]byte, error) {
+  return ns.fc.Read(path)
+}
+
+// Returns the full name of a template referenced by a template in the given namespace.
+func qualifyName(namespace, name string) string {
+  if strings.HasPrefix(name, "/") {
+    return strings.TrimPrefix(name, "/")
+  } else if namespace == "" {
+    return name
+  }
+  return namespace + "/" + name
+}
+
+// A mount is a FileCollection added to a Cache with Cache.Mount, along with the result of resolving it most
+// recently.
+type mount struct {
+  prefix string
+  fc     FileCollection
+  files  ResolvedFileCollection
+}
+
+// The FileCollection of a Cache with mounts, which combines the namespaced templates of every mount.
+type mounts []mount
+
+// Reads the file at the path from the first mount which has it, without resolving the mounts again. Paths which
+// were qualified with their mount can only be read through the ResolvedFileCollection returned by Resolve.
+func (m mounts) Read(path string) ([]byte, error) {
+  var firstErr error
+  for _, mnt := range m {
+    fc := mnt.fc
+    if mnt.files.FileCollection != nil {
+      fc = mnt.files.FileCollection
+    }
+    content, err := fc.Read(path)
+    if err == nil {
+      return content, nil
+    } else if firstErr == nil {
+      firstErr = err
+    }
+  }
+  if firstErr == nil {
+    firstErr = &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+  }
+  return nil, firstErr
+}
+
+func (m mounts) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(m, defaultResolution)
+}
+
+func (m mounts) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  resolved := make(mounts, len(m))
+  var duplicates []error
+  for i, mnt := range m {
+    files, mountDuplicates, err := resolveAll(Namespace(mnt.prefix, mnt.fc), res)
+    if err != nil {
+      return ResolvedFileCollection{}, nil, err
+    }
+    resolved[i] = mount{prefix: mnt.prefix, fc: mnt.fc, files: files}
+    duplicates = append(duplicates, mountDuplicates...)
+  }
+  files, mountDuplicates := resolved.combine()
+  return files, append(duplicates, mountDuplicates...), nil
+}
+
+// Combines the most recently resolved templates of every mount. A template name found in more than one mount is
+// reported as a DuplicateTemplateError.
+func (m mounts) combine() (ResolvedFileCollection, []error) {
+  resolved := resolvedMounts{mounts: m, files: make(map[string]mountFile)}
+  combined := ResolvedFileCollection{
+    FileCollection: resolved,
+    Paths:          make(map[string]string),
+    Shadows:        make(map[string]string),
+    namespaces:     make(map[string]string),
+    sources:        make(map[string]string),
+  }
+  var duplicates []error
+  for i, mnt := range m {
+    visible := make(map[string]bool, len(mnt.files.Names))
+    for _, name := range mnt.files.Names {
+      visible[name] = true
+    }
+    for _, name := range mnt.files.templateNames() {
+      if dup, ok := combined.Paths[name]; ok {
+        if visible[name] {
+          duplicates = append(duplicates, errDuplicateTemplate(name, dup, mnt.files.Paths[name]))
+        }
+        continue
+      }
+      if visible[name] {
+        combined.Names = append(combined.Names, name)
+      }
+      // Mounts can have the same paths as each other, such as two PreloadedFiles, so the path is qualified with the
+      // mount to tell them apart.
+      path := mnt.files.Paths[name]
+      if file, ok := resolved.files[path]; ok && file.mount != i {
+        path = fmt.Sprintf("%s (mount %s)", path, mnt.prefix)
+      }
+      resolved.files[path] = mountFile{mount: i, path: mnt.files.Paths[name]}
+      combined.Paths[name] = path
+      combined.namespaces[name] = mnt.files.namespaces[name]
+      combined.sources[name] = mnt.files.sourcePath(name)
+      if hidden, ok := mnt.files.Shadows[name]; ok {
+        combined.Shadows[name] = hidden
+      }
+    }
+  }
+  return combined, duplicates
+}
+
+// Returns a copy of the mounts with the given FileCollection mounted at the prefix, replacing any existing mount
+// with the same prefix. If fc is nil, the mount is removed.
+func (m mounts) with(prefix string, fc FileCollection, files ResolvedFileCollection) mounts {
+  var replaced mounts
+  for _, mnt := range m {
+    if mnt.prefix != prefix {
+      replaced = append(replaced, mnt)
+    }
+  }
+  if fc != nil {
+    replaced = append(replaced, mount{prefix: prefix, fc: fc, files: files})
+  }
+  return replaced
+}
+
+// The FileCollection of the combined mounts of a Cache, which reads each file from the mount it was found in.
+// Resolving it again resolves every mount again.
+type resolvedMounts struct {
+  mounts
+  files map[string]mountFile
+}
+
+type mountFile struct {
+  mount int
+  path  string
+}
+
+func (m resolvedMounts) Read(path string) ([]byte, error) {
+  file, ok := m.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+  }
+  return m.mounts[file.mount].files.FileCollection.Read(file.path)
+}
+
+func (c *templateCache) Mount(prefix string, fc FileCollection) error {
+  prefix = strings.Trim(prefix, "/")
+  c.update.Lock()
+  defer c.update.Unlock()
+  prev := c.set()
+  config := c.configFor(prev)
+  var files ResolvedFileCollection
+  if fc != nil {
+    var err error
+    if files, err = resolveWith(Namespace(prefix, fc), resolution{rule: config.nameRule}); err != nil {
+      return err
+    }
+  }
+  combined, duplicates := c.mounts().with(prefix, fc, files).combine()
+  if len(duplicates) > 0 {
+    return duplicates[0]
+  }
+
+  // Only the templates in the mount are read again, along with any templates which have moved in the combined
+  // collection.
+  changed := make(map[string]bool)
+  for name := range files.Paths {
+    changed[name] = true
+  }
+  for _, mnt := range c.mounts() {
+    if mnt.prefix == prefix {
+      for name := range mnt.files.Paths {
+        changed[name] = true
+      }
+    }
+  }
+  set, err := c.buildSet(combined, prev, changed, config)
+  if err != nil {
+    return err
+  }
+  c.publish(set)
+  return nil
+}
+
+func (c *templateCache) Unmount(prefix string) error {
+  return c.Mount(prefix, nil)
+}
+
+// Returns the mounts of the Cache. If the templates were loaded with Cache.Load, they are the only mount, with an
+// empty prefix.
+func (c *templateCache) mounts() mounts {
+  files := c.set().files
+  if resolved, ok := files.FileCollection.(resolvedMounts); ok {
+    return resolved.mounts
+  }
+  if files.FileCollection == nil {
+    return nil
+  }
+  return mounts{{fc: files.FileCollection, files: files}}
+}
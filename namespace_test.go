@@ -0,0 +1,89 @@
+package marmot
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestMount(t *testing.T) {
+  web := map[string][]byte{
+    "layout.tmpl": []byte(`[{{template "content"}}]`),
+    "footer.tmpl": []byte(`{{define "footer"}}footer{{end}}`),
+    "Page.tmpl":   []byte(`{{extend "layout"}}{{define "content"}}page{{end}}`),
+  }
+  email := map[string][]byte{
+    "base.tmpl":    []byte(`Hi {{template "content"}} {{template "footer"}}`),
+    "Welcome.tmpl": []byte(`{{extend "base"}}{{include "/web/footer"}}{{define "content"}}welcome{{end}}`),
+    "Page.tmpl":    []byte(`{{extend "/web/layout"}}{{define "content"}}email page{{end}}`),
+  }
+
+  cache := TextCache()
+  if err := cache.Mount("web", PreloadedFiles(web)); err != nil {
+    t.Fatal(err)
+  }
+  if err := cache.Mount("/email/", PreloadedFiles(email)); err != nil {
+    t.Fatal(err)
+  }
+
+  expect := func(key, output string) {
+    str, err := cache.Builder(key).ExecStr()
+    if err != nil {
+      t.Error(err)
+    } else if str != output {
+      t.Errorf("expected %q for %s, got %q", output, key, str)
+    }
+  }
+  expect("web/page", "[page]")
+  expect("email/welcome", "Hi welcome footer")
+  expect("email/page", "[email page]")
+
+  mounted := cache.(*templateCache).set().files.FileCollection.(resolvedMounts).mounts
+  if content, err := mounted.Read("Welcome.tmpl"); err != nil || string(content) != string(email["Welcome.tmpl"]) {
+    t.Errorf("expected a path to be read from the mount which has it, got %q %v", content, err)
+  }
+
+  webPage := cache.(*templateCache).set().templates["web/page"]
+  email["Welcome.tmpl"] = []byte(`{{extend "base"}}{{include "/web/footer"}}{{define "content"}}welcome back{{end}}`)
+  if err := cache.Mount("email", PreloadedFiles(email)); err != nil {
+    t.Fatal(err)
+  }
+  expect("email/welcome", "Hi welcome back footer")
+  if cache.(*templateCache).set().templates["web/page"] != webPage {
+    t.Error("expected templates in other mounts not to be rebuilt")
+  }
+
+  var missingErr *MissingDependencyError
+  if err := cache.Unmount("web"); !errors.As(err, &missingErr) || !strings.HasPrefix(missingErr.Name, "web/") {
+    t.Errorf("expected unmounting a dependency to fail, got %v", err)
+  }
+  expect("web/page", "[page]")
+
+  web["footer.tmpl"] = []byte(`{{define "footer"}}new footer{{end}}`)
+  if err := cache.Refresh("web/footer"); err != nil {
+    t.Fatal(err)
+  }
+  expect("email/welcome", "Hi welcome back new footer")
+
+  var dupErr *DuplicateTemplateError
+  err := cache.Mount("", PreloadedFiles(map[string][]byte{"email/base.tmpl": nil}))
+  if !errors.As(err, &dupErr) || dupErr.Name != "email/base" {
+    t.Errorf("expected a duplicate template error, got %v", err)
+  }
+
+  files, err := Namespace("a/b", PreloadedFiles(email)).Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "a/b/Page a/b/Welcome a/b/base" {
+    t.Errorf("unexpected templates %s", names)
+  }
+
+  if err := cache.Load(PreloadedFiles(web)); err != nil {
+    t.Fatal(err)
+  }
+  expect("page", "[page]")
+  if _, err := cache.Builder("email/welcome").ExecStr(); err == nil {
+    t.Error("expected Load to replace every mount")
+  }
+}
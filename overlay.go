@@ -0,0 +1,148 @@
+package marmot
+
+import (
+  "fmt"
+  "os"
+)
+
+// An OverlayFiles is a FileCollection made of layers, where a template in a later layer shadows any template with
+// the same name in an earlier layer, rather than being reported as a DuplicateTemplateError. It is created with
+// Overlay.
+//
+// A template can extend or include the template it shadows by using its own name. For example, a theme can
+// override a single block of the base layer's template page.gohtml with:
+//  {{extend "page"}}
+//  {{define "title"}}Themed title{{end}}
+//
+// Every other template name refers to the template from the latest layer which has it, so templates in the base
+// layer which extend or include a shadowed template use the override.
+//
+// The layer which supplied each template is given by ResolvedFileCollection.Layers.
+type OverlayFiles struct {
+  layers []FileCollection
+}
+
+// Creates a new OverlayFiles whose layers are the base collection followed by the overrides, in order. Duplicate
+// template names within a single layer are still reported as a DuplicateTemplateError.
+func Overlay(base FileCollection, overrides ...FileCollection) *OverlayFiles {
+  return &OverlayFiles{layers: append([]FileCollection{base}, overrides...)}
+}
+
+// Reads the file at the path from the first layer which has it, without resolving the overlay. Paths which Resolve
+// qualified with their layer can only be read through the ResolvedFileCollection it returned.
+func (o *OverlayFiles) Read(path string) ([]byte, error) {
+  var firstErr error
+  for _, layer := range o.layers {
+    content, err := layer.Read(path)
+    if err == nil {
+      return content, nil
+    } else if firstErr == nil {
+      firstErr = err
+    }
+  }
+  return nil, firstErr
+}
+
+func (o *OverlayFiles) Resolve() (ResolvedFileCollection, error) {
+  return resolveFirst(o, defaultResolution)
+}
+
+func (o *OverlayFiles) resolveAll(res resolution) (ResolvedFileCollection, []error, error) {
+  resolved := resolvedOverlay{OverlayFiles: o, files: make(map[string]overlayFile)}
+  var names []string
+  paths := make(map[string]string)
+  shadows := make(map[string]string)
+  namespaces := make(map[string]string)
+  sources := make(map[string]string)
+  layers := make(map[string]int)
+  var duplicates []error
+
+  for i, layer := range o.layers {
+    files, layerDuplicates, err := resolveAll(layer, res)
+    if err != nil {
+      return ResolvedFileCollection{}, nil, err
+    }
+    duplicates = append(duplicates, layerDuplicates...)
+    hiddenInLayer := make(map[string]bool)
+    for _, hidden := range files.Shadows {
+      hiddenInLayer[hidden] = true
+    }
+
+    for _, name := range files.templateNames() {
+      path := files.Paths[name]
+      // Layers which are not directories can have the same paths as each other, such as two PreloadedFiles, so the
+      // path is qualified with the layer to tell them apart.
+      if file, ok := resolved.files[path]; ok && file.layer != i {
+        path = fmt.Sprintf("%s (layer %d)", path, i)
+      }
+      resolved.files[path] = overlayFile{layer: i, fc: files.FileCollection, path: files.Paths[name]}
+
+      // A layer which is itself an overlay may already have shadowed templates, which keep their names.
+      if hiddenInLayer[name] {
+        paths[name], layers[name], namespaces[name] = path, i, files.namespaces[name]
+        sources[name] = files.sourcePath(name)
+        if next, ok := files.Shadows[name]; ok {
+          shadows[name] = next
+        }
+        continue
+      }
+
+      // The template from the earlier layer is given a hidden name, and goes to the bottom of the chain of
+      // templates shadowed by this one.
+      var hidden string
+      if prevLayer, ok := layers[name]; ok {
+        hidden = fmt.Sprintf("%s@%d", name, prevLayer)
+        for n := 2; paths[hidden] != ""; n++ {
+          hidden = fmt.Sprintf("%s@%d.%d", name, prevLayer, n)
+        }
+        paths[hidden], layers[hidden], namespaces[hidden] = paths[name], prevLayer, namespaces[name]
+        sources[hidden] = sources[name]
+        if prevHidden, ok := shadows[name]; ok {
+          shadows[hidden] = prevHidden
+        }
+      } else {
+        names = append(names, name)
+      }
+      bottom := name
+      for next, ok := files.Shadows[bottom]; ok; next, ok = files.Shadows[bottom] {
+        shadows[bottom], bottom = next, next
+      }
+      if hidden != "" {
+        shadows[bottom] = hidden
+      }
+      paths[name], layers[name], namespaces[name] = path, i, files.namespaces[name]
+      sources[name] = files.sourcePath(name)
+    }
+  }
+
+  return ResolvedFileCollection{
+    FileCollection: resolved,
+    Names:          names,
+    Paths:          paths,
+    Shadows:        shadows,
+    Layers:         layers,
+    namespaces:     namespaces,
+    sources:        sources,
+  }, duplicates, nil
+}
+
+// The FileCollection of a resolved overlay, which reads each file from the layer it was found in. Resolving it again
+// resolves every layer again.
+type resolvedOverlay struct {
+  *OverlayFiles
+  files map[string]overlayFile
+}
+
+type overlayFile struct {
+  layer int
+  fc    FileCollection
+  path  string
+}
+
+func (o resolvedOverlay) Read(path string) ([]byte, error) {
+  file, ok := o.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+  }
+  return file.fc.Read(file.path)
+}
@@ -0,0 +1,86 @@
+package marmot
+
+import (
+  "errors"
+  "strings"
+  "testing"
+)
+
+func TestOverlay(t *testing.T) {
+  base := PreloadedFiles(map[string][]byte{
+    "layout.tmpl": []byte(`<{{template "title"}}> {{template "content"}}`),
+    "title.tmpl":  []byte(`{{define "title"}}Base{{end}}`),
+    "Page.tmpl":   []byte(`{{extend "layout"}}{{include "title"}}{{define "content"}}page{{end}}`),
+    "About.tmpl":  []byte(`{{extend "layout"}}{{include "title"}}{{define "content"}}about{{end}}`),
+  })
+  theme := PreloadedFiles(map[string][]byte{
+    "title.tmpl": []byte(`{{define "title"}}Theme{{end}}`),
+    "Page.tmpl":  []byte(`{{extend "Page"}}{{define "content"}}themed{{end}}`),
+  })
+  customer := PreloadedFiles(map[string][]byte{
+    "Page.tmpl": []byte(`{{extend "Page"}}{{define "title"}}Customer{{end}}`),
+  })
+
+  overlay := Overlay(base, theme, customer)
+  cache := TextCache()
+  if err := cache.Load(overlay); err != nil {
+    t.Fatal(err)
+  }
+
+  expect := func(key, output string) {
+    str, err := cache.Builder(key).ExecStr()
+    if err != nil {
+      t.Error(err)
+    } else if str != output {
+      t.Errorf("expected %q for %s, got %q", output, key, str)
+    }
+  }
+  expect("about", "<Theme> about")
+  expect("page", "<Customer> themed")
+
+  files, err := overlay.Resolve()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if names := strings.Join(files.Names, " "); names != "About Page layout title" {
+    t.Errorf("unexpected templates %s", names)
+  }
+  if files.Shadows["Page"] != "Page@1" || files.Shadows["Page@1"] != "Page@0" || files.Shadows["title"] != "title@0" {
+    t.Errorf("unexpected shadows %v", files.Shadows)
+  }
+  if files.Paths["Page@1"] != "Page.tmpl (layer 1)" {
+    t.Errorf("expected paths shared between layers to be qualified, got %s", files.Paths["Page@1"])
+  }
+
+  for name, expectLayer := range map[string]int{"Page": 2, "Page@1": 1, "Page@0": 0, "title": 1, "About": 0} {
+    if layer, ok := files.Layers[name]; !ok || layer != expectLayer {
+      t.Errorf("expected %s to be supplied by layer %d, got %d", name, expectLayer, layer)
+    }
+  }
+  if _, ok := files.Layers["missing"]; ok {
+    t.Error("expected no layer for a missing template")
+  }
+  content, err := overlay.Read("Page.tmpl")
+  if expected := `{{extend "layout"}}{{include "title"}}{{define "content"}}page{{end}}`; err != nil ||
+    string(content) != expected {
+    t.Errorf("expected an unqualified path to be read from the first layer with it, got %q %v", content, err)
+  }
+
+  if stack, _ := cache.Graph().Stack("page"); strings.Join(stack, " ") != "layout Page@0 title Page@1 Page" {
+    t.Errorf("unexpected stack %v", stack)
+  }
+
+  nested := Overlay(overlay, PreloadedFiles(map[string][]byte{
+    "Page.tmpl": []byte(`{{extend "Page"}}{{define "content"}}nested{{end}}`),
+  }))
+  if err := cache.Load(nested); err != nil {
+    t.Fatal(err)
+  }
+  expect("page", "<Customer> nested")
+
+  var dupErr *DuplicateTemplateError
+  err = TextCache().Load(Overlay(PreloadedFiles(map[string][]byte{"a.tmpl": nil, "a.html": nil})))
+  if !errors.As(err, &dupErr) {
+    t.Errorf("expected duplicates within a layer to be reported, got %v", err)
+  }
+}
@@ -0,0 +1,55 @@
+package marmot
+
+import (
+  "sync"
+  "sync/atomic"
+)
+
+// Calls fn for every index in [0,n) using at most the given number of goroutines, and returns the error returned
+// for the lowest index, which is the same error that calling fn for each index in order would stop at.
+//
+// Indexes are handed out in increasing order, and no further indexes are handed out once any call has failed.
+// Every index lower than a failed one has therefore already been handed out, so the lowest error is always found.
+func parallel(workers, n int, fn func(i int) error) error {
+  if workers <= 1 || n <= 1 {
+    for i := 0; i < n; i++ {
+      if err := fn(i); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+  if workers > n {
+    workers = n
+  }
+
+  errs := make([]error, n)
+  jobs := make(chan int)
+  var failed int32
+  var wg sync.WaitGroup
+
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := range jobs {
+        if errs[i] = fn(i); errs[i] != nil {
+          atomic.StoreInt32(&failed, 1)
+        }
+      }
+    }()
+  }
+
+  for i := 0; i < n && atomic.LoadInt32(&failed) == 0; i++ {
+    jobs <- i
+  }
+  close(jobs)
+  wg.Wait()
+
+  for _, err := range errs {
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
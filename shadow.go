@@ -0,0 +1,141 @@
+package marmot
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "math/rand"
+)
+
+// A ShadowDiff reports an execution whose output from the shadow templates loaded with Cache.LoadShadow differed from
+// its output from the live templates.
+type ShadowDiff struct {
+  // The key of the template which was executed.
+  Key string
+  // The hex-encoded SHA-256 hash of the data the template was executed with, which can be used to group executions
+  // with the same data. The data is hashed in its JSON encoding if it has one, and in Go syntax otherwise.
+  Fingerprint string
+  // A unified diff from the live output to the shadow output, or an empty string if executing the shadow template
+  // failed. If the outputs differ by too many lines to diff cheaply, the diff only says that they differ.
+  Diff string
+  // The error returned by executing the shadow template, if it failed.
+  Err error
+}
+
+// The shadow templates being rendered alongside the live ones.
+type shadowRun struct {
+  set    *templateSet
+  rate   float64
+  onDiff func(ShadowDiff)
+  // Limits the number of shadow executions running at once. Samples taken while every slot is in use are skipped,
+  // so that shadow rendering cannot build up a backlog.
+  slots chan struct{}
+}
+
+func (c *templateCache) LoadShadow(fc FileCollection, rate float64, onDiff func(ShadowDiff)) error {
+  c.update.Lock()
+  defer c.update.Unlock()
+  config := c.configuration()
+  files, err := resolveWith(fc, resolution{rule: config.nameRule})
+  if err != nil {
+    return err
+  }
+  set, err := c.buildSet(files, nil, nil, config)
+  if err != nil {
+    return err
+  }
+  c.loads++
+  set.load = c.loads
+  workers := config.workers
+  if workers < 1 {
+    workers = 1
+  }
+  c.replaceShadow(&shadowRun{set: set, rate: rate, onDiff: onDiff, slots: make(chan struct{}, workers)})
+  return nil
+}
+
+func (c *templateCache) PromoteShadow() error {
+  c.update.Lock()
+  defer c.update.Unlock()
+  run := c.shadowRun()
+  if run == nil {
+    return fmt.Errorf("cannot promote shadow templates when none have been loaded")
+  }
+  c.publish(run.set)
+  c.replaceShadow(nil)
+  return nil
+}
+
+func (c *templateCache) DiscardShadow() {
+  c.update.Lock()
+  defer c.update.Unlock()
+  c.replaceShadow(nil)
+}
+
+// Replaces the shadow templates, removing the compiled templates of the previous shadow templates from the Cache
+// unless they have been promoted and are still kept. The update lock must be held.
+func (c *templateCache) replaceShadow(run *shadowRun) {
+  prev := c.shadowRun()
+  c.shadow.Store(run)
+  if prev != nil {
+    c.dropLazy([]*templateSet{prev.set}, c.history())
+  }
+}
+
+func (c *templateCache) shadowRun() *shadowRun {
+  run, _ := c.shadow.Load().(*shadowRun)
+  return run
+}
+
+// Returns the shadow templates if an execution of the current generation should also be rendered with them.
+func (c *templateCache) sampleShadow(generation int) *shadowRun {
+  if generation != 0 {
+    return nil
+  }
+  run := c.shadowRun()
+  if run == nil || run.rate <= 0 || (run.rate < 1 && rand.Float64() >= run.rate) {
+    return nil
+  }
+  return run
+}
+
+// Executes the shadow template in the background and reports its output if it differs from the live output.
+func (run *shadowRun) render(c *templateCache, key string, data DataMap, live string) {
+  select {
+  case run.slots <- struct{}{}:
+  default:
+    return
+  }
+  // The caller may reuse its DataMap once the live execution returns, but the values in it are shared with the shadow
+  // execution, as documented by Cache.LoadShadow.
+  copied := make(DataMap, len(data))
+  for k, v := range data {
+    copied[k] = v
+  }
+  go func() {
+    defer func() { <-run.slots }()
+    buf := new(bytes.Buffer)
+    err := c.execSet(buf, run.set, key, copied)
+    if err == nil && buf.String() == live {
+      return
+    }
+    diff := ShadowDiff{Key: key, Fingerprint: fingerprint(copied), Err: err}
+    if err == nil {
+      diff.Diff = unifiedDiff("live", "shadow", live, buf.String())
+    }
+    if run.onDiff != nil {
+      run.onDiff(diff)
+    }
+  }()
+}
+
+func fingerprint(data DataMap) string {
+  encoded, err := json.Marshal(data)
+  if err != nil {
+    encoded = []byte(fmt.Sprintf("%#v", data))
+  }
+  hash := sha256.Sum256(encoded)
+  return hex.EncodeToString(hash[:])
+}
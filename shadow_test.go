@@ -0,0 +1,173 @@
+package marmot
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+  tests := []struct {
+    a, b string
+    diff string
+  }{
+    {"same\n", "same\n", ""},
+    {
+      "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+      "1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n11\n12\nthirteen\n",
+      "--- a\n+++ b\n" +
+        "@@ -1,7 +1,7 @@\n 1\n 2\n 3\n-4\n+four\n 5\n 6\n 7\n" +
+        "@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+thirteen\n",
+    },
+    {"", "new", "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+new\n\\ No newline at end of file\n"},
+    {"a\nb\nc", "a\nc", "--- a\n+++ b\n@@ -1,3 +1,2 @@\n a\n-b\n c\n\\ No newline at end of file\n"},
+  }
+
+  for _, testData := range tests {
+    if diff := unifiedDiff("a", "b", testData.a, testData.b); diff != testData.diff {
+      t.Errorf("unexpected diff of %q and %q:\n%s\nexpected:\n%s", testData.a, testData.b, diff, testData.diff)
+    }
+  }
+
+  // Long outputs which differ near both ends are diffed without comparing every pair of lines.
+  var long, changed, other []string
+  for i := 0; i < 20000; i++ {
+    long = append(long, fmt.Sprintf("%d\n", i))
+    other = append(other, fmt.Sprintf("other %d\n", i))
+  }
+  changed = append(append([]string{"first\n"}, long[1:len(long)-1]...), "last\n")
+  lines, ok := diffLines(long, changed)
+  var a, b strings.Builder
+  for _, line := range lines {
+    if line.op != '+' {
+      a.WriteString(line.text)
+    }
+    if line.op != '-' {
+      b.WriteString(line.text)
+    }
+  }
+  if !ok || len(lines) != 20002 || a.String() != strings.Join(long, "") || b.String() != strings.Join(changed, "") {
+    t.Errorf("unexpected diff of long outputs: %d lines", len(lines))
+  }
+  expected := "--- a\n+++ b\noutputs differ (diff too large)\n"
+  if diff := unifiedDiff("a", "b", strings.Join(long, ""), strings.Join(other, "")); diff != expected {
+    t.Errorf("expected outputs with too many changes not to be diffed, got %d bytes", len(diff))
+  }
+}
+
+func TestShadow(t *testing.T) {
+  live := map[string][]byte{
+    "Page.tmpl":  []byte("<h1>{{$.Title}}</h1>\n<p>{{$.Body}}</p>\n"),
+    "Other.tmpl": []byte("other\n"),
+  }
+  shadow := map[string][]byte{
+    "Page.tmpl":  []byte("<h1>{{$.Title}}</h1>\n<p class=\"body\">{{$.Body}}</p>\n"),
+    "Other.tmpl": []byte("other\n"),
+  }
+
+  cache := TextCache()
+  if err := cache.Load(PreloadedFiles(live)); err != nil {
+    t.Fatal(err)
+  }
+  if err := cache.PromoteShadow(); err == nil {
+    t.Error("expected promoting without shadow templates to fail")
+  }
+
+  diffs := make(chan ShadowDiff, 10)
+  release := make(chan struct{})
+  err := cache.LoadShadow(PreloadedFiles(shadow), 1, func(diff ShadowDiff) {
+    <-release
+    diffs <- diff
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  data := DataMap{"Title": "Hello", "Body": "World"}
+  str, err := cache.Builder("page").WithAll(data).ExecStr()
+  if err != nil || str != "<h1>Hello</h1>\n<p>World</p>\n" {
+    t.Errorf("unexpected live output %q %v", str, err)
+  }
+  // The live execution has returned even though the shadow execution is still waiting to report its diff.
+  close(release)
+
+  select {
+  case diff := <-diffs:
+    if diff.Key != "page" || diff.Err != nil || diff.Fingerprint != fingerprint(data) {
+      t.Errorf("unexpected diff %+v", diff)
+    }
+    expected := "--- live\n+++ shadow\n@@ -1,2 +1,2 @@\n" +
+      " <h1>Hello</h1>\n-<p>World</p>\n+<p class=\"body\">World</p>\n"
+    if diff.Diff != expected {
+      t.Errorf("unexpected diff:\n%s", diff.Diff)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("expected a diff to be reported")
+  }
+
+  if _, err := cache.Builder("other").ExecStr(); err != nil {
+    t.Fatal(err)
+  }
+  delete(shadow, "Other.tmpl")
+  if err := cache.LoadShadow(PreloadedFiles(shadow), 1, func(diff ShadowDiff) { diffs <- diff }); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := cache.Builder("other").ExecStr(); err != nil {
+    t.Fatal(err)
+  }
+  select {
+  case diff := <-diffs:
+    var notFound *TemplateNotFoundError
+    if !errors.As(diff.Err, &notFound) || diff.Diff != "" {
+      t.Errorf("expected a missing shadow template to be reported, got %+v", diff)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("expected a failed shadow execution to be reported")
+  }
+
+  if err := cache.PromoteShadow(); err != nil {
+    t.Fatal(err)
+  }
+  str, err = cache.Builder("page").WithAll(data).ExecStr()
+  if err != nil || str != "<h1>Hello</h1>\n<p class=\"body\">World</p>\n" {
+    t.Errorf("unexpected output after promoting %q %v", str, err)
+  }
+  if cache.Generation() != 2 {
+    t.Errorf("expected the shadow templates to be generation 2, got %d", cache.Generation())
+  }
+  if _, err := cache.Builder("page").WithAll(data).ExecStr(); err != nil {
+    t.Fatal(err)
+  }
+  select {
+  case diff := <-diffs:
+    t.Errorf("expected shadow rendering to stop once promoted, got %+v", diff)
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  lazy := newTemplateCache(textTemplateCreator{}, LazyCompilation(true))
+  if err := lazy.Load(PreloadedFiles(live)); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 2; i++ {
+    if err := lazy.LoadShadow(PreloadedFiles(shadow), 1, func(diff ShadowDiff) { diffs <- diff }); err != nil {
+      t.Fatal(err)
+    }
+    if _, err := lazy.Builder("page").WithAll(data).ExecStr(); err != nil {
+      t.Fatal(err)
+    }
+    select {
+    case <-diffs:
+    case <-time.After(time.Second):
+      t.Fatal("expected a diff to be reported")
+    }
+    if lazy.compiled.list.Len() != 2 {
+      t.Errorf("expected the live and shadow templates to be compiled, got %d", lazy.compiled.list.Len())
+    }
+  }
+  lazy.DiscardShadow()
+  if lazy.compiled.list.Len() != 1 {
+    t.Errorf("expected discarding to remove the compiled shadow templates, got %d", lazy.compiled.list.Len())
+  }
+}
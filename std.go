@@ -5,7 +5,7 @@ import (
   "reflect"
 )
 
-// Returns the Marmot template function standard library. Pass into Cache.Functions to use.
+// Returns the Marmot template function standard library. Pass into Funcs to use.
 //
 // The standard library contains the following functions:
 //  - (add a b): adds two ints
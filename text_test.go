@@ -43,7 +43,7 @@ func TestText(t *testing.T) {
   }
 
   for _, testData := range tests {
-    cache := TextCache().WithFuncs(Std())
+    cache := TextCache(Funcs(Std()))
 
     if err := cache.Load(testData.fc); err != nil {
       t.Error(err)
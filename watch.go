@@ -0,0 +1,205 @@
+package marmot
+
+import (
+  "io/fs"
+  "os"
+  "sync"
+  "time"
+)
+
+const (
+  // The default amount of time a Watcher waits between checking its Dir for changes.
+  DefaultWatchInterval = 500 * time.Millisecond
+
+  // The default amount of time the files in a Watcher's Dir must be left unchanged before the Cache is reloaded.
+  DefaultWatchDebounce = 100 * time.Millisecond
+)
+
+// A Watcher polls the files in a Dir, which may be a Directory or an FS, and reloads a Cache whenever any of them
+// are added, removed or modified. Only the templates affected by the changed files are rebuilt, using
+// Cache.Refresh.
+//
+// The Watcher only reloads the templates it loaded itself, along with any Cache.Mount alongside them: once the Cache
+// has been loaded from another FileCollection, changes to the Dir are ignored.
+//
+// Changes are debounced, so saving several files in quick succession only causes a single reload. If a reload
+// fails, the Cache keeps serving the templates from the last successful load and the error is passed to the
+// callback given to Watcher.OnError.
+//
+// To create a Watcher, use Watch.
+type Watcher struct {
+  cache    Cache
+  dir      Dir
+  interval time.Duration
+  debounce time.Duration
+  onError  func(error)
+  load     int
+  stop     chan struct{}
+  done     chan struct{}
+  started  sync.Once
+  closed   sync.Once
+}
+
+// Implemented by FileCollections whose paths are not OS paths which can be passed to os.Stat.
+type statter interface {
+  stat(path string) (fs.FileInfo, error)
+}
+
+type fileStamp struct {
+  path    string
+  modTime time.Time
+  size    int64
+}
+
+// A dirSnapshot maps each template name in a Dir to the state of its file.
+type dirSnapshot map[string]fileStamp
+
+// Creates a new Watcher which reloads the given Cache from the given Dir whenever the files in the Dir change.
+// The Watcher does nothing until Watcher.Start is called.
+func Watch(cache Cache, dir Dir) *Watcher {
+  return &Watcher{
+    cache:    cache,
+    dir:      dir,
+    interval: DefaultWatchInterval,
+    debounce: DefaultWatchDebounce,
+    stop:     make(chan struct{}),
+    done:     make(chan struct{}),
+  }
+}
+
+// Specifies how often the Dir is checked for changes.
+func (w *Watcher) WithInterval(interval time.Duration) *Watcher {
+  w.interval = interval
+  return w
+}
+
+// Specifies how long the files in the Dir must be left unchanged before the Cache is reloaded.
+func (w *Watcher) WithDebounce(debounce time.Duration) *Watcher {
+  w.debounce = debounce
+  return w
+}
+
+// Specifies a callback which is called with any error encountered while checking for changes or reloading the
+// Cache. The callback is called from the Watcher's background goroutine.
+func (w *Watcher) OnError(fn func(error)) *Watcher {
+  w.onError = fn
+  return w
+}
+
+// Loads the templates in the Dir into the Cache, then starts watching the Dir for changes in the background.
+//
+// If the initial load fails, the error is returned and the Watcher is not started.
+func (w *Watcher) Start() error {
+  snapshot, err := w.snapshot()
+  if err != nil {
+    return err
+  }
+  // The number of the load is kept so that the Watcher can tell if the Cache is loaded from elsewhere.
+  load, err := w.cache.load(w.dir)
+  if err != nil {
+    return err
+  }
+  w.load = load
+  w.started.Do(func() {
+    go w.run(snapshot)
+  })
+  return nil
+}
+
+// Stops watching the Dir for changes. Close blocks until the Watcher's background goroutine has exited, so the
+// Cache will not be reloaded by the Watcher after Close returns.
+func (w *Watcher) Close() error {
+  w.closed.Do(func() {
+    close(w.stop)
+  })
+  w.started.Do(func() {
+    close(w.done)
+  })
+  <-w.done
+  return nil
+}
+
+func (w *Watcher) run(current dirSnapshot) {
+  defer close(w.done)
+  ticker := time.NewTicker(w.interval)
+  defer ticker.Stop()
+  changed := make(map[string]bool)
+  var pending bool
+  var lastChange time.Time
+  for {
+    select {
+    case <-w.stop:
+      return
+    case now := <-ticker.C:
+      snapshot, err := w.snapshot()
+      if err != nil {
+        w.report(err)
+        continue
+      }
+      if names := snapshot.diff(current); len(names) > 0 {
+        for _, name := range names {
+          changed[name] = true
+        }
+        current, pending, lastChange = snapshot, true, now
+        continue
+      }
+      if pending && now.Sub(lastChange) >= w.debounce {
+        pending = false
+        names := make([]string, 0, len(changed))
+        for name := range changed {
+          names = append(names, name)
+        }
+        // If the refresh fails, the changed names are kept so that they are retried along with the next change.
+        if err := w.cache.refresh(w.load, names); err != nil {
+          w.report(err)
+        } else {
+          changed = make(map[string]bool)
+        }
+      }
+    }
+  }
+}
+
+func (w *Watcher) snapshot() (dirSnapshot, error) {
+  files, err := w.cache.resolve(w.dir)
+  if err != nil {
+    return nil, err
+  }
+  snapshot := make(dirSnapshot, len(files.Paths))
+  stat := os.Stat
+  if statter, ok := files.FileCollection.(statter); ok {
+    stat = statter.stat
+  }
+  for name, path := range files.Paths {
+    info, err := stat(path)
+    if err != nil {
+      return nil, err
+    }
+    snapshot[name] = fileStamp{path: path, modTime: info.ModTime(), size: info.Size()}
+  }
+  return snapshot, nil
+}
+
+func (w *Watcher) report(err error) {
+  if w.onError != nil {
+    w.onError(err)
+  }
+}
+
+// Returns the names of the templates which have been added, removed or modified between other and s.
+func (s dirSnapshot) diff(other dirSnapshot) []string {
+  var names []string
+  for name, stamp := range s {
+    otherStamp, ok := other[name]
+    if !ok || otherStamp.path != stamp.path || otherStamp.size != stamp.size ||
+      !otherStamp.modTime.Equal(stamp.modTime) {
+      names = append(names, name)
+    }
+  }
+  for name := range other {
+    if _, ok := s[name]; !ok {
+      names = append(names, name)
+    }
+  }
+  return names
+}
@@ -0,0 +1,80 @@
+package marmot
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestWatch(t *testing.T) {
+  dir, err := ioutil.TempDir("", "marmot")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  writeFile := func(name, content string) {
+    if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  writeFile("base.tmpl", `Hello {{template "name" .}}`)
+  writeFile("Page.tmpl", `{{extend "base"}}{{define "name"}}world{{end}}`)
+
+  errs := make(chan error, 16)
+  cache := TextCache()
+  watcher := Watch(cache, Directory(dir).MatchExtensions("tmpl")).
+    WithInterval(10 * time.Millisecond).
+    WithDebounce(20 * time.Millisecond).
+    OnError(func(err error) { errs <- err })
+
+  if err := watcher.Start(); err != nil {
+    t.Fatal(err)
+  }
+  defer watcher.Close()
+
+  expectOutput := func(expect string) {
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+      str, err := cache.Builder("page").ExecStr()
+      if err == nil && strings.TrimSpace(str) == expect {
+        return
+      }
+      if time.Now().After(deadline) {
+        t.Fatalf("expected %q, got %q (error: %v)", expect, str, err)
+      }
+      time.Sleep(5 * time.Millisecond)
+    }
+  }
+
+  expectOutput("Hello world")
+
+  writeFile("Page.tmpl", `{{extend "base"}}{{define "name"}}marmot{{end}}`)
+  expectOutput("Hello marmot")
+
+  writeFile("Page.tmpl", `{{extend "base"}}{{define "name"}}{{end`)
+  select {
+  case <-errs:
+  case <-time.After(2 * time.Second):
+    t.Fatal("expected reload error")
+  }
+  expectOutput("Hello marmot")
+
+  if err := cache.Load(PreloadedFiles(map[string][]byte{"Page.tmpl": []byte(`Hello elsewhere`)})); err != nil {
+    t.Fatal(err)
+  }
+  generation := cache.Generation()
+  writeFile("Page.tmpl", `{{extend "base"}}{{define "name"}}watched{{end}}`)
+  time.Sleep(100 * time.Millisecond)
+  if cache.Generation() != generation {
+    t.Errorf("expected the Watcher to leave templates loaded from elsewhere, got generation %d", cache.Generation())
+  }
+
+  if err := watcher.Close(); err != nil {
+    t.Error(err)
+  }
+}